@@ -0,0 +1,195 @@
+package capabilities
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ninjasphere/go-ninja/api"
+	"github.com/ninjasphere/go-ninja/logger"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/schemas"
+	"github.com/ninjasphere/redigo/redis"
+	"github.com/ninjasphere/sphere-go-homecloud/models"
+)
+
+// Method is a single method of a channel protocol, with the schemas of its parameters
+type Method struct {
+	Name    string      `json:"name"`
+	Params  interface{} `json:"params,omitempty"`
+	Returns interface{} `json:"returns,omitempty"`
+}
+
+// Protocol describes what a channel schema (i.e. "/protocol/on-off") can do
+type Protocol struct {
+	Schema  string   `json:"schema"`
+	Methods []Method `json:"methods"`
+	Events  []string `json:"events"`
+}
+
+type ChannelCapabilities struct {
+	ChannelID string    `json:"channelId"`
+	Protocol  string    `json:"protocol"`
+	Schema    *Protocol `json:"schema,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type ThingCapabilities struct {
+	ThingID  string                 `json:"thingId"`
+	Channels []*ChannelCapabilities `json:"channels"`
+}
+
+// Catalogue resolves the capabilities of things from the go-ninja schemas of their channels.
+// Schemas don't change while we're running, so they are only resolved once.
+type Catalogue struct {
+	sync.Mutex
+	Conn       *ninja.Connection  `inject:""`
+	ThingModel *models.ThingModel `inject:""`
+	log        *logger.Logger
+	protocols  map[string]*Protocol
+}
+
+func NewCatalogue() *Catalogue {
+	return &Catalogue{
+		log:       logger.GetLogger("Capabilities"),
+		protocols: make(map[string]*Protocol),
+	}
+}
+
+func (c *Catalogue) PostConstruct() error {
+	_, err := c.Conn.ExportService(c, "$home/services/Capabilities", &model.ServiceAnnouncement{
+		Schema: "/service/capabilities",
+	})
+	return err
+}
+
+// FetchProtocol resolves a channel schema uri to its methods and events
+func (c *Catalogue) FetchProtocol(schema string) (*Protocol, error) {
+	c.Lock()
+	protocol, ok := c.protocols[schema]
+	c.Unlock()
+
+	if ok {
+		return protocol, nil
+	}
+
+	c.log.Debugf("Resolving schema %s", schema)
+
+	methods, err := schemas.GetDocument(schema+"#/methods", true)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve methods of schema %s: %s", schema, err)
+	}
+
+	events, err := schemas.GetDocument(schema+"#/events", true)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to resolve events of schema %s: %s", schema, err)
+	}
+
+	protocol = &Protocol{
+		Schema:  schema,
+		Methods: []Method{},
+		Events:  []string{},
+	}
+
+	for name, definition := range methods {
+		method := Method{Name: name}
+		if definition, ok := definition.(map[string]interface{}); ok {
+			method.Params = definition["params"]
+			method.Returns = definition["returns"]
+		}
+		protocol.Methods = append(protocol.Methods, method)
+	}
+
+	sort.Sort(byName(protocol.Methods))
+
+	for name := range events {
+		protocol.Events = append(protocol.Events, name)
+	}
+
+	sort.Strings(protocol.Events)
+
+	c.Lock()
+	c.protocols[schema] = protocol
+	c.Unlock()
+
+	return protocol, nil
+}
+
+// FetchThingCapabilities returns the capabilities of each channel of a thing's device
+func (c *Catalogue) FetchThingCapabilities(thingID string, conn redis.Conn) (*ThingCapabilities, error) {
+
+	// Fetch wraps its errors, so RecordNotFound has to be checked for first
+	exists, err := c.ThingModel.Exists(thingID, conn)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, models.RecordNotFound
+	}
+
+	thing, err := c.ThingModel.Fetch(thingID, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	capabilities := &ThingCapabilities{
+		ThingID:  thing.ID,
+		Channels: []*ChannelCapabilities{},
+	}
+
+	if thing.Device == nil || thing.Device.Channels == nil {
+		return capabilities, nil
+	}
+
+	for _, channel := range *thing.Device.Channels {
+		channelCapabilities := &ChannelCapabilities{
+			ChannelID: channel.ID,
+			Protocol:  channel.Protocol,
+		}
+
+		// One broken schema shouldn't hide the rest of the thing
+		if protocol, err := c.FetchProtocol(channel.Schema); err != nil {
+			channelCapabilities.Error = err.Error()
+		} else {
+			channelCapabilities.Schema = protocol
+		}
+
+		capabilities.Channels = append(capabilities.Channels, channelCapabilities)
+	}
+
+	return capabilities, nil
+}
+
+// FetchSiteCapabilities returns the ids of the things supporting each channel protocol
+func (c *Catalogue) FetchSiteCapabilities(conn redis.Conn) (map[string][]string, error) {
+
+	things, err := c.ThingModel.FetchAll(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	protocols := make(map[string][]string)
+
+	for _, thing := range *things {
+		if thing.Device == nil || thing.Device.Channels == nil {
+			continue
+		}
+
+		seen := make(map[string]bool)
+
+		for _, channel := range *thing.Device.Channels {
+			if !seen[channel.Protocol] {
+				seen[channel.Protocol] = true
+				protocols[channel.Protocol] = append(protocols[channel.Protocol], thing.ID)
+			}
+		}
+	}
+
+	return protocols, nil
+}
+
+type byName []Method
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
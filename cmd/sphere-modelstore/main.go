@@ -0,0 +1,34 @@
+// sphere-modelstore is a local stand-in for the cloud's modelstore. Point one or more spheres'
+// sync connections at the same MQTT broker to test syncing, deletion and clearing the cloud offline.
+package main
+
+import (
+	"github.com/ninjasphere/go-ninja/api"
+	"github.com/ninjasphere/go-ninja/config"
+	"github.com/ninjasphere/go-ninja/logger"
+	"github.com/ninjasphere/go-ninja/support"
+	"github.com/ninjasphere/sphere-go-homecloud/modelstore"
+)
+
+var log = logger.GetLogger("sphere-modelstore")
+
+func main() {
+
+	store, err := modelstore.NewStore(config.String("modelstore.json", "modelstore.file"))
+	if err != nil {
+		log.Fatalf("Failed to load store: %s", err)
+	}
+
+	conn, err := ninja.Connect("sphere-modelstore")
+	if err != nil {
+		log.Fatalf("Failed to connect to mqtt: %s", err)
+	}
+
+	if err := modelstore.NewServer(conn, store).Start(); err != nil {
+		log.Fatalf("Failed to start modelstore: %s", err)
+	}
+
+	log.Infof("Local modelstore ready")
+
+	support.WaitUntilSignal()
+}
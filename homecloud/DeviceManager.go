@@ -3,25 +3,33 @@ package homecloud
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/ninjasphere/go-ninja/api"
 	"github.com/ninjasphere/go-ninja/logger"
 	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/schemas"
 	"github.com/ninjasphere/redigo/redis"
 	"github.com/ninjasphere/sphere-go-homecloud/models"
 )
 
 type DeviceManager struct {
-	Conn         *ninja.Connection    `inject:""`
-	DeviceModel  *models.DeviceModel  `inject:""`
-	ChannelModel *models.ChannelModel `inject:""`
-	ThingModel   *models.ThingModel   `inject:""`
-	Pool         *redis.Pool          `inject:""`
-	log          *logger.Logger
+	Conn            *ninja.Connection       `inject:""`
+	DeviceModel     *models.DeviceModel     `inject:""`
+	ChannelModel    *models.ChannelModel    `inject:""`
+	ThingModel      *models.ThingModel      `inject:""`
+	RoomModel       *models.RoomModel       `inject:""`
+	QuarantineModel *models.QuarantineModel `inject:""`
+	Pool            *redis.Pool             `inject:""`
+	log             *logger.Logger
+	relay           *eventRelay
+	reconciler      *channelReconciler
 }
 
 func (m *DeviceManager) PostConstruct() error {
 	m.log = logger.GetLogger("DeviceManager")
+	m.relay = newEventRelay(m.log)
+	m.reconciler = newChannelReconciler(m.log, m.Pool, m.ChannelModel)
 	err := m.Start()
 	if err != nil {
 		return err
@@ -29,8 +37,20 @@ func (m *DeviceManager) PostConstruct() error {
 	return nil
 }
 
+// Stop stops the device manager's background work
+func (m *DeviceManager) Stop() {
+	m.relay.stop()
+}
+
+// RelayCounts returns the number of device events relayed (or not) to things, keyed by event name
+func (m *DeviceManager) RelayCounts() map[string]RelayCounts {
+	return m.relay.snapshot()
+}
+
 func (m *DeviceManager) Start() error {
 
+	m.QuarantineModel.SetRetryHandler(m.reprocessAnnouncement)
+
 	// Listen for device announcements, and save them to redis
 	_, err := m.Conn.Subscribe("$device/:id/event/announce", func(announcement *json.RawMessage, values map[string]string) bool {
 
@@ -43,18 +63,10 @@ func (m *DeviceManager) Start() error {
 			return true
 		}
 
-		device := &model.Device{}
-		err := json.Unmarshal(*announcement, device)
-
-		if announcement == nil {
-			log.Warningf("Could not parse announcement from device:%s error:%s", id, err)
-			return true
-		}
-
 		conn := m.Pool.Get()
 		defer conn.Close()
 
-		err = m.DeviceModel.Create(device, conn)
+		err := m.saveDeviceAnnouncement(id, *announcement, conn)
 		if err != nil {
 			log.Warningf("Failed to save device announcement for device:%s error:%s", id, err)
 		}
@@ -78,17 +90,10 @@ func (m *DeviceManager) Start() error {
 			return true
 		}
 
-		channel := &model.Channel{}
-		err := json.Unmarshal(*announcement, channel)
-
-		if err != nil {
-			log.Warningf("Could not parse channel announcement from device:%s channel:%s error:%s", deviceID, channelID, err)
-			return true
-		}
-
 		conn := m.Pool.Get()
 		defer conn.Close()
-		err = m.ChannelModel.Create(deviceID, channel, conn)
+
+		err := m.saveChannelAnnouncement(deviceID, channelID, *announcement, conn)
 		if err != nil {
 			log.Warningf("Failed to save channel announcement for device:%s channel:%s error:%s", deviceID, channelID, err)
 		}
@@ -100,11 +105,13 @@ func (m *DeviceManager) Start() error {
 		return err
 	}
 
-	/*// Map device events to thing events
+	// Map device events to thing events
 	_, err = m.Conn.SubscribeRaw("$device/:device/channel/:channel/event/:event", func(payload *json.RawMessage, values map[string]string) bool {
 
-		if values["event"] == "announce" {
-			// We don't care about announcements
+		event := values["event"]
+
+		if !m.relay.enabled(event) {
+			m.relay.count(event, relayFiltered)
 			return true
 		}
 
@@ -112,14 +119,18 @@ func (m *DeviceManager) Start() error {
 		defer conn.Close()
 		thing, err := m.ThingModel.GetThingIDForDevice(values["device"], conn)
 		if err != nil {
-			log.Errorf("Got an event, but failed to fetch the thing id for device: %s error: %s", values["device"], err)
+			if err != models.RecordNotFound {
+				log.Errorf("Got an event, but failed to fetch the thing id for device: %s error: %s", values["device"], err)
+			}
+			m.relay.count(event, relayNoThing)
 			return true
 		}
 
-		m.Conn.GetMqttClient().Publish(fmt.Sprintf("$thing/%s/channel/%s/event/%s", *thing, values["channel"], values["event"]), *payload)
+		m.Conn.GetMqttClient().Publish(fmt.Sprintf("$thing/%s/channel/%s/event/%s", *thing, values["channel"], event), *payload)
+		m.relay.count(event, relayRelayed)
 
 		return true
-	})*/
+	})
 
 	if err != nil {
 		return err
@@ -161,5 +172,197 @@ func (m *DeviceManager) Start() error {
 		return true
 	})
 
+	if err != nil {
+		return err
+	}
+
+	// Fan room actuations out to every thing in the room with that channel
+	_, err = m.Conn.SubscribeRaw("$room/:room/channel/:channel", func(payload *json.RawMessage, values map[string]string) bool {
+
+		request := &roomActuation{}
+		if err := json.Unmarshal(*payload, request); err != nil {
+			log.Warningf("Could not parse room actuation for room: %s channel: %s error: %s", values["room"], values["channel"], err)
+			return true
+		}
+
+		conn := m.Pool.Get()
+		defer conn.Close()
+
+		reply := &roomActuationReply{Version: "2.0", ID: request.ID}
+
+		results, err := m.RoomModel.Actuate(values["room"], values["channel"], request.Method, request.Params, conn)
+		if err != nil {
+			log.Errorf("Failed to actuate room: %s channel: %s error: %s", values["room"], values["channel"], err)
+			reply.Error = &roomActuationError{Code: -32000, Message: err.Error()}
+		} else {
+			reply.Result = results
+		}
+
+		replyPayload, err := json.Marshal(reply)
+		if err != nil {
+			log.Errorf("Failed to serialise room actuation reply for room: %s error: %s", values["room"], err)
+			return true
+		}
+
+		m.Conn.GetMqttClient().Publish(fmt.Sprintf("$room/%s/channel/%s/reply", values["room"], values["channel"]), replyPayload)
+
+		return true
+	})
+
 	return err
 }
+
+type roomActuation struct {
+	ID     interface{}      `json:"id"`
+	Method string           `json:"method"`
+	Params *json.RawMessage `json:"params,omitempty"`
+}
+
+type roomActuationError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type roomActuationReply struct {
+	Version string                             `json:"jsonrpc"`
+	ID      interface{}                        `json:"id"`
+	Result  map[string]*models.ActuationResult `json:"result,omitempty"`
+	Error   *roomActuationError                `json:"error,omitempty"`
+}
+
+const (
+	deviceAnnouncementSchema  = "/model/device"
+	channelAnnouncementSchema = "/model/channel"
+)
+
+func (m *DeviceManager) saveDeviceAnnouncement(id string, announcement json.RawMessage, conn redis.Conn) error {
+
+	device := &model.Device{}
+
+	problem := m.validateAnnouncement(deviceAnnouncementSchema, announcement, device)
+	if problem == nil && device.ID != id {
+		problem = fmt.Errorf("Announced device id %s does not match topic device id %s", device.ID, id)
+	}
+
+	if problem != nil {
+		return m.quarantine(id, nil, announcement, problem, conn)
+	}
+
+	m.clearQuarantine(id, nil, conn)
+
+	if err := m.DeviceModel.Create(device, conn); err != nil {
+		return err
+	}
+
+	m.reconciler.deviceAnnounced(id)
+
+	return nil
+}
+
+func (m *DeviceManager) saveChannelAnnouncement(deviceID, channelID string, announcement json.RawMessage, conn redis.Conn) error {
+
+	blacklisted, err := m.DeviceModel.IsBlacklistedDevice(deviceID, conn)
+	if err != nil {
+		return err
+	}
+
+	if blacklisted {
+		m.log.Debugf("Ignoring channel %s of blacklisted device %s", channelID, deviceID)
+		return nil
+	}
+
+	// Even an invalid announcement tells us the channel still exists
+	m.reconciler.channelAnnounced(deviceID, channelID)
+
+	channel := &model.Channel{}
+
+	problem := m.validateAnnouncement(channelAnnouncementSchema, announcement, channel)
+	if problem == nil && channel.ID != channelID {
+		problem = fmt.Errorf("Announced channel id %s does not match topic channel id %s", channel.ID, channelID)
+	}
+
+	if problem != nil {
+		return m.quarantine(deviceID, &channelID, announcement, problem, conn)
+	}
+
+	m.clearQuarantine(deviceID, &channelID, conn)
+
+	pending, err := m.DeviceModel.IsPending(deviceID, conn)
+	if err != nil {
+		return err
+	}
+
+	if pending {
+		// Saved when (and if) the device is approved
+		return m.DeviceModel.HoldChannel(deviceID, channel, conn)
+	}
+
+	return m.ChannelModel.Create(deviceID, channel, conn)
+}
+
+// validateAnnouncement parses an announcement into obj, and checks it against its schema.
+// If the schema itself can't be loaded the announcement is given the benefit of the doubt.
+func (m *DeviceManager) validateAnnouncement(schema string, announcement json.RawMessage, obj interface{}) error {
+
+	if err := json.Unmarshal(announcement, obj); err != nil {
+		return fmt.Errorf("Could not parse announcement: %s", err)
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(announcement, &raw); err != nil {
+		return fmt.Errorf("Could not parse announcement: %s", err)
+	}
+
+	message, err := schemas.Validate(schema, raw)
+	if err != nil {
+		m.log.Warningf("Could not validate announcement against schema %s, accepting it anyway. error:%s", schema, err)
+		return nil
+	}
+
+	if message != nil {
+		return fmt.Errorf("Announcement does not match schema %s: %s", schema, *message)
+	}
+
+	return nil
+}
+
+func (m *DeviceManager) quarantine(deviceID string, channelID *string, announcement json.RawMessage, problem error, conn redis.Conn) error {
+
+	item := &models.QuarantinedAnnouncement{
+		ID:       models.QuarantineID(deviceID, channelID),
+		Type:     "device",
+		DeviceID: deviceID,
+		Payload:  announcement,
+		Error:    problem.Error(),
+		Received: time.Now(),
+	}
+
+	if channelID != nil {
+		item.Type = "channel"
+		item.ChannelID = *channelID
+	}
+
+	if err := m.QuarantineModel.Add(item, conn); err != nil {
+		return fmt.Errorf("Failed to quarantine invalid announcement (%s) error:%s", problem, err)
+	}
+
+	return fmt.Errorf("Announcement was quarantined as %s: %s", item.ID, problem)
+}
+
+// clearQuarantine drops any earlier invalid announcement, now that a valid one has arrived
+func (m *DeviceManager) clearQuarantine(deviceID string, channelID *string, conn redis.Conn) {
+	err := m.QuarantineModel.Discard(models.QuarantineID(deviceID, channelID), conn)
+	if err != nil && err != models.RecordNotFound {
+		m.log.Warningf("Failed to clear quarantined announcement for device:%s error:%s", deviceID, err)
+	}
+}
+
+func (m *DeviceManager) reprocessAnnouncement(item *models.QuarantinedAnnouncement, conn redis.Conn) error {
+	switch item.Type {
+	case "device":
+		return m.saveDeviceAnnouncement(item.DeviceID, item.Payload, conn)
+	case "channel":
+		return m.saveChannelAnnouncement(item.DeviceID, item.ChannelID, item.Payload, conn)
+	}
+	return fmt.Errorf("Unknown quarantined announcement type: %s", item.Type)
+}
@@ -1,6 +1,8 @@
 package homecloud
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -21,21 +23,34 @@ var syncEnabled = config.Bool(true, "homecloud.sync.enabled")
 var syncTimeout = config.MustDuration("homecloud.sync.timeout")
 
 type HomeCloud struct {
-	Conn         *ninja.Connection    `inject:""`
-	Pool         *redis.Pool          `inject:""`
-	ThingModel   *models.ThingModel   `inject:""`
-	DeviceModel  *models.DeviceModel  `inject:""`
-	ChannelModel *models.ChannelModel `inject:""`
-	RoomModel    *models.RoomModel    `inject:""`
-	ModuleModel  *models.ModuleModel  `inject:""`
-	SiteModel    *models.SiteModel    `inject:""`
-	log          *logger.Logger
+	Conn            *ninja.Connection       `inject:""`
+	Pool            *redis.Pool             `inject:""`
+	ThingModel      *models.ThingModel      `inject:""`
+	DeviceModel     *models.DeviceModel     `inject:""`
+	ChannelModel    *models.ChannelModel    `inject:""`
+	RoomModel       *models.RoomModel       `inject:""`
+	ModuleModel     *models.ModuleModel     `inject:""`
+	SiteModel       *models.SiteModel       `inject:""`
+	FloorModel      *models.FloorModel      `inject:""`
+	QuarantineModel *models.QuarantineModel `inject:""`
+	SyncMonitor     *models.SyncMonitor     `inject:""`
+	log             *logger.Logger
+
+	changeSyncers map[syncable]*changeSyncer
+	breaker       *circuitBreaker
+	syncNow       chan bool
 }
 
 func (c *HomeCloud) PostConstruct() error {
 
 	c.log = logger.GetLogger("HomeCloud")
 
+	// Show what a sync would do, without doing it. i.e. --previewsync=thing or --previewsync=all
+	if model := config.String("", "previewsync"); model != "" {
+		c.previewSync(model)
+		os.Exit(0)
+	}
+
 	c.ExportRPCServices()
 	c.ensureSiteExists()
 
@@ -46,13 +61,22 @@ func (c *HomeCloud) PostConstruct() error {
 	}
 
 	if syncEnabled {
-		// We wait for at least one sync to happen, or fail
-		<-c.StartSyncing(config.MustDuration("homecloud.sync.interval"))
-	}
+		interval := config.MustDuration("homecloud.sync.interval")
+		if syncOnChange {
+			// Changes are pushed as they happen, the full sync is just a safety net
+			interval = config.Duration(time.Hour, "homecloud.sync.safetyInterval")
+		}
+
+		syncComplete := c.StartSyncing(interval)
 
-	// This is required to enable sphere-reset to clear out redis, then push this empty db to
-	// cloud.
-	if config.Bool(false, "clearcloud") {
+		// This is required to enable sphere-reset to clear out redis, then push this empty db to
+		// cloud. Otherwise we don't wait for the cloud, it may well be unreachable.
+		if config.Bool(false, "clearcloud") {
+			<-syncComplete
+			c.log.Infof("Just clearing cloud so exiting now!")
+			os.Exit(0)
+		}
+	} else if config.Bool(false, "clearcloud") {
 		c.log.Infof("Just clearing cloud so exiting now!")
 		os.Exit(0)
 	}
@@ -72,6 +96,8 @@ func (c *HomeCloud) ClearCloud() {
 	c.DeviceModel.ClearCloud()
 	c.RoomModel.ClearCloud()
 	c.SiteModel.ClearCloud()
+	c.FloorModel.ClearCloud()
+	c.ModuleModel.ClearCloud()
 
 	log.Infof("All cloud data cleared.")
 
@@ -90,62 +116,175 @@ func (c *HomeCloud) ExportRPCServices() {
 	c.Conn.MustExportService(c.SiteModel, "$home/services/SiteModel", &model.ServiceAnnouncement{
 		Schema: "/service/site-model",
 	})
+	c.Conn.MustExportService(c.FloorModel, "$home/services/FloorModel", &model.ServiceAnnouncement{
+		Schema: "/service/floor-model",
+	})
+	c.Conn.MustExportService(&quarantineService{c.QuarantineModel}, "$home/services/QuarantineModel", &model.ServiceAnnouncement{
+		Schema: "/service/quarantine-model",
+	})
+	c.Conn.MustExportService(c.SyncMonitor, "$home/services/SyncStatus", &model.ServiceAnnouncement{
+		Schema: "/service/sync-status",
+	})
 }
 
 type syncable interface {
 	Sync(timeout time.Duration, conn redis.Conn) error
+	SyncJournal(timeout time.Duration, conn redis.Conn) error
+	SetChangeHandler(handler func(id string))
+	SetPendingCounter(counter func() int)
+}
+
+func modelName(model syncable) string {
+	return reflect.TypeOf(model).Elem().Name()
 }
 
+// StartSyncing syncs every model with the cloud every interval. A model that fails to sync is
+// retried sooner, backing off as it keeps failing, and nothing is synced while the circuit
+// breaker is open. The returned channel gets the result of the first round of syncing.
 func (c *HomeCloud) StartSyncing(interval time.Duration) chan bool {
 
-	syncComplete := make(chan bool)
+	syncComplete := make(chan bool, 1)
 
-	syncModels := []syncable{c.RoomModel, c.DeviceModel, c.ChannelModel, c.ThingModel, c.SiteModel}
+	syncModels := []syncable{c.RoomModel, c.DeviceModel, c.ChannelModel, c.ThingModel, c.SiteModel, c.FloorModel, c.ModuleModel}
+
+	c.breaker = newCircuitBreaker(c.log)
+	c.syncNow = make(chan bool, 1)
+	c.changeSyncers = make(map[syncable]*changeSyncer)
+
+	if syncOnChange {
+		for _, model := range syncModels {
+			syncer := newChangeSyncer(c.log, c.Pool, model, c.breaker)
+			c.changeSyncers[model] = syncer
+			model.SetChangeHandler(syncer.changed)
+			model.SetPendingCounter(syncer.pendingCount)
+		}
+	}
+
+	c.SyncMonitor.SetSyncTrigger(c.SyncNow)
 
 	go func() {
 
 		// XXX: Give us a few seconds to clean up the db if we have to.
 		time.Sleep(time.Second * 5)
 
-		for {
+		backoffs := make(map[syncable]*backoff)
+		due := make(map[syncable]time.Time)
+		for _, model := range syncModels {
+			backoffs[model] = &backoff{}
+		}
 
-			c.log.Infof("\n\n\n------ Timed model syncing started (every %s) ------ ", interval.String())
+		first := true
+		forced := false
 
-			//var wg sync.WaitGroup
+		for {
 
-			//wg.Add(len(syncModels))
+			c.log.Infof("\n\n\n------ Timed model syncing started (every %s, forced? %t) ------ ", interval.String(), forced)
 
 			success := true
+			attempted := 0
 
 			for _, model := range syncModels {
+				if !forced && time.Now().Before(due[model]) {
+					continue
+				}
+
+				if !forced && !c.breaker.allow() {
+					c.log.Infof("Not syncing model %s, the cloud is unreachable", modelName(model))
+					success = false
+
+					// Try again when the breaker next lets a sync through, rather than straight away
+					retryIn := c.breaker.retryIn()
+					if retryIn < time.Second {
+						retryIn = time.Second
+					}
+					due[model] = time.Now().Add(retryIn)
+					continue
+				}
+
+				attempted++
+
 				func(model syncable) {
 					conn := c.Pool.Get()
 					defer conn.Close()
+					started := time.Now()
 					err := model.Sync(syncTimeout, conn)
 					if err != nil {
-						c.log.Warningf("Failed to sync model %s : %s", reflect.TypeOf(model).String(), err)
+						delay := backoffs[model].failed()
+						c.log.Warningf("Failed to sync model %s, retrying in %s : %s", reflect.TypeOf(model).String(), delay, err)
+						c.breaker.failed()
+						due[model] = backoffs[model].until
 						success = false
+					} else {
+						backoffs[model].succeeded()
+						c.breaker.succeeded()
+						due[model] = started.Add(interval)
+						if syncer, ok := c.changeSyncers[model]; ok {
+							syncer.synced(started)
+						}
 					}
-					//wg.Done()
 				}(model)
 			}
 
-			//wg.Wait()
+			log.Infof("------ Timed model syncing complete. Synced %d model(s). Success? %t ------\n\n\n", attempted, success)
 
-			log.Infof("------ Timed model syncing complete. Success? %t ------\n\n\n", success)
+			if first {
+				syncComplete <- success
+				first = false
+			}
 
-			select {
-			case syncComplete <- success:
-			default:
+			// Sleep until the next model is due, or we're asked to sync now
+			next := time.Now().Add(interval)
+			for _, t := range due {
+				if t.Before(next) {
+					next = t
+				}
 			}
 
-			time.Sleep(interval)
+			select {
+			case <-time.After(next.Sub(time.Now())):
+				forced = false
+			case <-c.syncNow:
+				forced = true
+			}
 		}
 	}()
 
 	return syncComplete
 }
 
+// SyncNow syncs every model straight away, ignoring any backoff or the circuit breaker
+func (c *HomeCloud) SyncNow() {
+	select {
+	case c.syncNow <- true:
+	default:
+		// Already asked
+	}
+}
+
+func (c *HomeCloud) previewSync(model string) {
+	conn := c.Pool.Get()
+	defer conn.Close()
+
+	if model == "all" {
+		model = ""
+	}
+
+	previews, err := c.SyncMonitor.PreviewSync(model, nil, conn)
+	if err == models.RecordNotFound {
+		log.Fatalf("Unknown model to preview: %s", model)
+	}
+	if err != nil {
+		log.Fatalf("Failed to preview sync: %s", err)
+	}
+
+	out, err := json.MarshalIndent(previews, "", "  ")
+	if err != nil {
+		log.Fatalf("Failed to serialise sync preview: %s", err)
+	}
+
+	fmt.Println(string(out))
+}
+
 func (c *HomeCloud) ensureSiteExists() {
 	conn := c.Pool.Get()
 	defer conn.Close()
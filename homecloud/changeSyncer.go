@@ -0,0 +1,144 @@
+package homecloud
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+	"github.com/ninjasphere/go-ninja/logger"
+	"github.com/ninjasphere/redigo/redis"
+)
+
+var syncOnChange = config.Bool(true, "homecloud.sync.onChange")
+var syncDebounce = config.Duration(time.Second*2, "homecloud.sync.debounce")
+var syncMaxDelay = config.Duration(time.Second*30, "homecloud.sync.maxDelay")
+
+// changeSyncer pushes the objects that change in a model to the cloud soon after they change,
+// instead of waiting for the next full sync. Changes are debounced, so a burst of saves (i.e. a
+// device announcing all its channels) goes in one sync, but a steady stream of them is still
+// pushed within homecloud.sync.maxDelay of the first.
+type changeSyncer struct {
+	sync.Mutex
+	log     *logger.Logger
+	pool    *redis.Pool
+	model   syncable
+	breaker *circuitBreaker
+	pending map[string]time.Time // id -> when it changed
+	first   time.Time            // when the first of the pending changes was made
+	timer   *time.Timer
+}
+
+func newChangeSyncer(log *logger.Logger, pool *redis.Pool, model syncable, breaker *circuitBreaker) *changeSyncer {
+	return &changeSyncer{
+		log:     log,
+		pool:    pool,
+		model:   model,
+		breaker: breaker,
+		pending: make(map[string]time.Time),
+	}
+}
+
+func (s *changeSyncer) changed(id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+
+	if len(s.pending) == 0 {
+		s.first = now
+	}
+	s.pending[id] = now
+
+	delay := syncDebounce
+	if wait := syncMaxDelay - now.Sub(s.first); wait < delay {
+		delay = wait
+	}
+	if delay < 0 {
+		delay = 0
+	}
+
+	if s.timer == nil {
+		s.timer = time.AfterFunc(delay, s.flush)
+	} else {
+		s.timer.Reset(delay)
+	}
+}
+
+func (s *changeSyncer) flush() {
+	if s.pendingCount() == 0 {
+		return
+	}
+
+	if !s.breaker.allow() {
+		// Keep them until the cloud is back, and try again then
+		s.retryLater()
+		return
+	}
+
+	s.Lock()
+	changes := s.pending
+	s.pending = make(map[string]time.Time)
+	s.Unlock()
+
+	ids := make([]string, 0, len(changes))
+	for id := range changes {
+		ids = append(ids, id)
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	// The journal has these, and anything changed before a restart that hasn't been synced yet
+	if err := s.model.SyncJournal(syncTimeout, conn); err != nil {
+		s.log.Warningf("Failed to sync %d changed %s(s): %s", len(ids), modelName(s.model), err)
+		s.breaker.failed()
+
+		// Keep them, and try again later. The wait for new changes starts again, so they don't
+		// each retry straight away.
+		s.Lock()
+		s.first = time.Now()
+		for id, t := range changes {
+			if _, ok := s.pending[id]; !ok {
+				s.pending[id] = t
+			}
+		}
+		s.Unlock()
+
+		s.retryLater()
+	} else {
+		s.breaker.succeeded()
+	}
+}
+
+// retryLater flushes again once the breaker will let a sync through, or after the debounce
+// delay if it already would
+func (s *changeSyncer) retryLater() {
+	delay := s.breaker.retryIn()
+	if delay < syncDebounce {
+		delay = syncDebounce
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.timer.Reset(delay)
+}
+
+// synced drops the changes made before a successful full sync started, as that sync included them
+func (s *changeSyncer) synced(started time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	for id, t := range s.pending {
+		if t.Before(started) {
+			delete(s.pending, id)
+		}
+	}
+}
+
+func (s *changeSyncer) pendingCount() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.pending)
+}
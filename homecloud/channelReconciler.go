@@ -0,0 +1,116 @@
+package homecloud
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+	"github.com/ninjasphere/go-ninja/logger"
+	"github.com/ninjasphere/redigo/redis"
+	"github.com/ninjasphere/sphere-go-homecloud/models"
+)
+
+var reconcileChannels = config.Bool(true, "homecloud.channels.reconcile")
+var reconcileWindow = config.Duration(time.Second*30, "homecloud.channels.reconcileWindow")
+
+// channelReconciler retires channels that a driver stops announcing. After a device is
+// announced, we wait for its channels to be announced. Any existing channel that isn't
+// announced within the grace window is deleted.
+type channelReconciler struct {
+	sync.Mutex
+	log          *logger.Logger
+	pool         *redis.Pool
+	channelModel *models.ChannelModel
+	pending      map[string]map[string]bool // deviceID -> announced channel ids
+	timers       map[string]*time.Timer
+	generations  map[string]int // deviceID -> generation of its latest announcement, so a stale reconcile is ignored
+	generation   int            // Shared by all devices, so a generation is never reused once forgotten
+}
+
+func newChannelReconciler(log *logger.Logger, pool *redis.Pool, channelModel *models.ChannelModel) *channelReconciler {
+	return &channelReconciler{
+		log:          log,
+		pool:         pool,
+		channelModel: channelModel,
+		pending:      make(map[string]map[string]bool),
+		timers:       make(map[string]*time.Timer),
+		generations:  make(map[string]int),
+	}
+}
+
+// deviceAnnounced (re)starts the grace window for a device
+func (r *channelReconciler) deviceAnnounced(deviceID string) {
+	if !reconcileChannels {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.pending[deviceID] = make(map[string]bool)
+
+	// The previous timer may already have fired, with its reconcile waiting on the lock. The
+	// generation tells it that it has been superseded.
+	r.generation++
+	generation := r.generation
+	r.generations[deviceID] = generation
+
+	if timer, ok := r.timers[deviceID]; ok {
+		timer.Stop()
+	}
+
+	r.timers[deviceID] = time.AfterFunc(reconcileWindow, func() {
+		r.reconcile(deviceID, generation)
+	})
+}
+
+func (r *channelReconciler) channelAnnounced(deviceID, channelID string) {
+	r.Lock()
+	defer r.Unlock()
+
+	if announced, ok := r.pending[deviceID]; ok {
+		announced[channelID] = true
+	}
+}
+
+func (r *channelReconciler) reconcile(deviceID string, generation int) {
+	r.Lock()
+	if r.generations[deviceID] != generation {
+		// The device was announced again, its new window has its own reconcile
+		r.Unlock()
+		return
+	}
+	announced := r.pending[deviceID]
+	delete(r.pending, deviceID)
+	delete(r.timers, deviceID)
+	delete(r.generations, deviceID)
+	r.Unlock()
+
+	if len(announced) == 0 {
+		// Some drivers announce their device again without its channels. Retiring
+		// everything would be far worse than keeping a stale channel.
+		r.log.Debugf("No channels announced for device:%s within %s, leaving its channels alone", deviceID, reconcileWindow)
+		return
+	}
+
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	existing, err := r.channelModel.FetchIds(deviceID, conn)
+	if err != nil {
+		r.log.Warningf("Failed to fetch channels to reconcile for device:%s error:%s", deviceID, err)
+		return
+	}
+
+	for _, channelID := range existing {
+		if announced[channelID] {
+			continue
+		}
+
+		r.log.Infof("Channel %s was not re-announced by device:%s, retiring it", channelID, deviceID)
+
+		if err := r.channelModel.Delete(deviceID, channelID, conn); err != nil {
+			r.log.Warningf("Failed to retire channel %s of device:%s error:%s", channelID, deviceID, err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package homecloud
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+	"github.com/ninjasphere/go-ninja/logger"
+)
+
+var relayMetricsInterval = config.Duration(time.Minute*5, "homecloud.relay.metricsInterval")
+
+type relayOutcome int
+
+const (
+	relayRelayed relayOutcome = iota
+	relayFiltered
+	relayNoThing
+)
+
+// RelayCounts holds the number of device events seen for a single event name
+type RelayCounts struct {
+	Relayed  uint64 `json:"relayed"`
+	Filtered uint64 `json:"filtered"`
+	NoThing  uint64 `json:"noThing"`
+}
+
+// eventRelay decides which device events are republished as thing events, and
+// keeps count of what happened to each of them.
+type eventRelay struct {
+	sync.Mutex
+	log     *logger.Logger
+	allowed map[string]bool
+	counts  map[string]*RelayCounts
+	done    chan bool
+}
+
+func newEventRelay(log *logger.Logger) *eventRelay {
+	r := &eventRelay{
+		log:     log,
+		allowed: make(map[string]bool),
+		counts:  make(map[string]*RelayCounts),
+		done:    make(chan bool),
+	}
+
+	if relayMetricsInterval > 0 {
+		go r.logMetrics()
+	}
+
+	return r
+}
+
+// logMetrics logs the counters every homecloud.relay.metricsInterval, until the relay is stopped
+func (r *eventRelay) logMetrics() {
+	ticker := time.NewTicker(relayMetricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for event, counts := range r.snapshot() {
+				r.log.Infof("Event relay %s: relayed:%d filtered:%d noThing:%d", event, counts.Relayed, counts.Filtered, counts.NoThing)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *eventRelay) stop() {
+	close(r.done)
+}
+
+// enabled reports whether an event should be relayed. Each event can be switched on or off
+// with "homecloud.relay.events.<event>". Everything except announcements is relayed by default.
+func (r *eventRelay) enabled(event string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	allowed, ok := r.allowed[event]
+	if !ok {
+		allowed = config.Bool(event != "announce", "homecloud.relay.events", event)
+		r.allowed[event] = allowed
+	}
+
+	return allowed
+}
+
+func (r *eventRelay) count(event string, outcome relayOutcome) {
+	r.Lock()
+	defer r.Unlock()
+
+	counts, ok := r.counts[event]
+	if !ok {
+		counts = &RelayCounts{}
+		r.counts[event] = counts
+	}
+
+	switch outcome {
+	case relayRelayed:
+		counts.Relayed++
+	case relayFiltered:
+		counts.Filtered++
+	case relayNoThing:
+		counts.NoThing++
+	}
+}
+
+// snapshot returns a copy of the relay counters, keyed by event name
+func (r *eventRelay) snapshot() map[string]RelayCounts {
+	r.Lock()
+	defer r.Unlock()
+
+	snapshot := make(map[string]RelayCounts, len(r.counts))
+	for event, counts := range r.counts {
+		snapshot[event] = *counts
+	}
+
+	return snapshot
+}
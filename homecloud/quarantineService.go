@@ -0,0 +1,28 @@
+package homecloud
+
+import (
+	"github.com/ninjasphere/redigo/redis"
+	"github.com/ninjasphere/sphere-go-homecloud/models"
+)
+
+// quarantineService is what's exported of the QuarantineModel over RPC. Adding announcements and
+// setting the retry handler are left to the device manager.
+type quarantineService struct {
+	model *models.QuarantineModel
+}
+
+func (s *quarantineService) FetchAll(conn redis.Conn) (*[]*models.QuarantinedAnnouncement, error) {
+	return s.model.FetchAll(conn)
+}
+
+func (s *quarantineService) Fetch(id string, conn redis.Conn) (*models.QuarantinedAnnouncement, error) {
+	return s.model.Fetch(id, conn)
+}
+
+func (s *quarantineService) Retry(id string, conn redis.Conn) error {
+	return s.model.Retry(id, conn)
+}
+
+func (s *quarantineService) Delete(id string, conn redis.Conn) error {
+	return s.model.Discard(id, conn)
+}
@@ -0,0 +1,112 @@
+package homecloud
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+	"github.com/ninjasphere/go-ninja/logger"
+)
+
+var syncBackoffMin = config.Duration(time.Second*30, "homecloud.sync.backoff.min")
+var syncBackoffMax = config.Duration(time.Minute*30, "homecloud.sync.backoff.max")
+var breakerThreshold = config.Int(3, "homecloud.sync.breaker.threshold")
+var breakerCooldown = config.Duration(time.Minute*5, "homecloud.sync.breaker.cooldown")
+
+// backoff spaces out the retries of a model that keeps failing to sync. The delay doubles with
+// each failure, up to a maximum, and is jittered so the models don't all retry at once.
+type backoff struct {
+	failures int
+	until    time.Time
+}
+
+func (b *backoff) failed() time.Duration {
+	b.failures++
+
+	delay := syncBackoffMax
+	if b.failures <= 16 {
+		if d := syncBackoffMin << uint(b.failures-1); d < delay {
+			delay = d
+		}
+	}
+
+	// Somewhere between half and all of the delay
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+	b.until = time.Now().Add(delay)
+	return delay
+}
+
+func (b *backoff) succeeded() {
+	b.failures = 0
+	b.until = time.Time{}
+}
+
+// circuitBreaker stops all syncing for a while once enough syncs in a row have failed, as the
+// cloud is probably unreachable. After the cooldown a single sync is let through to try it again.
+type circuitBreaker struct {
+	sync.Mutex
+	log       *logger.Logger
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(log *logger.Logger) *circuitBreaker {
+	return &circuitBreaker{log: log}
+}
+
+// allow says whether a sync can be attempted
+func (b *circuitBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.failures < breakerThreshold {
+		return true
+	}
+
+	if time.Now().Before(b.openUntil) {
+		return false
+	}
+
+	// Let this one through, and hold the rest back until we know how it went
+	b.openUntil = time.Now().Add(breakerCooldown)
+	return true
+}
+
+// retryIn is how long until the next sync will be let through
+func (b *circuitBreaker) retryIn() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.failures < breakerThreshold {
+		return 0
+	}
+
+	return b.openUntil.Sub(time.Now())
+}
+
+func (b *circuitBreaker) failed() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures++
+
+	if b.failures >= breakerThreshold {
+		if b.failures == breakerThreshold {
+			b.log.Warningf("Cloud looks to be unreachable after %d failed syncs, not syncing for %s", b.failures, breakerCooldown)
+		}
+		b.openUntil = time.Now().Add(breakerCooldown)
+	}
+}
+
+func (b *circuitBreaker) succeeded() {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.failures >= breakerThreshold {
+		b.log.Infof("Cloud is reachable again, syncing resumed")
+	}
+
+	b.failures = 0
+}
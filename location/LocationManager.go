@@ -1,63 +1,120 @@
-package homecloud
+package location
 
 import (
 	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/ninjasphere/go-ninja/api"
+	"github.com/ninjasphere/go-ninja/config"
 	"github.com/ninjasphere/go-ninja/logger"
 	"github.com/ninjasphere/go-ninja/model"
 	"github.com/ninjasphere/redigo/redis"
 )
 
+// How long an rssi reading is considered when looking for the device being calibrated with
+var rssiWindow = config.Duration(time.Second*5, "homecloud.location.rssiWindow")
+
+// How long a calibration can go without reporting progress before it is given up on
+var calibrationTimeout = config.Duration(time.Minute*2, "homecloud.location.calibrationTimeout")
+
 type LocationManager interface {
 	Calibrate(roomID, deviceID string, reset bool) error
+	GetCalibrationDevice() (*CalibrationDevice, error)
+	GetCalibrationProgress() (*CalibrationStatus, error)
+	GetCalibrationScores() (map[string]float64, error)
 }
 
+// CalibrationDevice is an rssi reading of a device (i.e. a tag or phone) seen by a sphere
 type CalibrationDevice struct {
-	Device string
-	Name   *string
-	Rssi   int
+	Device string    `json:"device"`
+	Name   *string   `json:"name,omitempty"`
+	Rssi   int       `json:"rssi"`
+	Seen   time.Time `json:"seen"`
 }
 
-type NinjaLocationManager struct {
-	redisPool *redis.Pool
+type calibrationProgress struct {
+	Zone     string   `json:"zone"`
+	Device   string   `json:"device"`
+	Progress float64  `json:"progress"`
+	Score    *float64 `json:"score,omitempty"`
+}
 
-	log               *logger.Logger
-	conn              *ninja.Connection
-	calibrationDevice string
-	calibrationZone   string
-	isCalibrating     bool
+// calibrationDelete is sent (as a notification) when a room is deleted
+type calibrationDelete struct {
+	Zone string `json:"zone"`
 }
 
-func NewLocationManager(redisPool *redis.Pool) LocationManager {
+type CalibrationState string
 
-	log := logger.GetLogger("sphere-go-homecloud-location")
+const (
+	CalibrationIdle        CalibrationState = "idle"
+	CalibrationCalibrating CalibrationState = "calibrating"
+	CalibrationComplete    CalibrationState = "complete"
+)
 
-	conn, err := ninja.Connect("sphere-go-homecloud-location")
+// CalibrationStatus is which device is calibrating which room, and how far along it is. If the
+// last calibration timed out, it is idle again with the Error saying so.
+type CalibrationStatus struct {
+	State    CalibrationState `json:"state"`
+	Zone     string           `json:"zone,omitempty"`
+	Device   string           `json:"device,omitempty"`
+	Progress float64          `json:"progress"`
+	Started  *time.Time       `json:"started,omitempty"`
+	Score    *float64         `json:"score,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
 
-	if err != nil {
-		log.FatalError(err, "Failed to connect to mqtt")
-	}
+type NinjaLocationManager struct {
+	sync.Mutex
+	Conn *ninja.Connection `inject:""`
+	Pool *redis.Pool       `inject:""`
+
+	log          *logger.Logger
+	status       CalibrationStatus
+	lastProgress time.Time
+	rssi         map[string]*CalibrationDevice
+}
 
-	locationManager := &NinjaLocationManager{
-		redisPool: redisPool,
-		log:       log,
-		conn:      conn,
+func NewLocationManager() LocationManager {
+	return &NinjaLocationManager{
+		log:    logger.GetLogger("sphere-go-homecloud-location"),
+		status: CalibrationStatus{State: CalibrationIdle},
+		rssi:   make(map[string]*CalibrationDevice),
 	}
+}
+
+func (n *NinjaLocationManager) PostConstruct() error {
 
-	conn.MustExportService(locationManager, "$home/LocationManager", &model.ServiceAnnouncement{
+	_, err := n.Conn.ExportService(n, "$home/LocationManager", &model.ServiceAnnouncement{
 		Schema: "/service/location",
 	})
+	if err != nil {
+		return err
+	}
 
-	conn.Subscribe("$device/:deviceId/:channel/rssi", locationManager.handRSSI)
+	if _, err := n.Conn.Subscribe("$device/:deviceId/:channel/rssi", n.handleRSSI); err != nil {
+		return err
+	}
 
-	conn.Subscribe("$location/calibration/progress", locationManager.handleCalibrationProgress)
+	if _, err := n.Conn.Subscribe("$location/calibration/progress", n.handleCalibrationProgress); err != nil {
+		return err
+	}
 
-	return locationManager
+	_, err = n.Conn.Subscribe("$location/calibration/delete", n.handleCalibrationDelete)
+	return err
 }
 
+// Calibrate starts calibrating a room, using readings from the given device. If reset is
+// set, any previous calibration of the room is thrown away first.
 func (n *NinjaLocationManager) Calibrate(roomID, deviceID string, reset bool) error {
 
+	if roomID == "" || deviceID == "" {
+		return fmt.Errorf("Both a room and a device are required to calibrate")
+	}
+
 	if reset {
 
 		payload, _ := json.Marshal(&map[string]string{
@@ -65,22 +122,203 @@ func (n *NinjaLocationManager) Calibrate(roomID, deviceID string, reset bool) er
 		})
 
 		// delete the room calibration information
-		n.conn.GetMqttClient().Publish(0, "$location/delete", payload)
+		n.Conn.GetMqttClient().Publish("$location/delete", payload)
+
+		if err := n.deleteScore(roomID); err != nil {
+			return err
+		}
+	}
+
+	n.Lock()
+	now := time.Now()
+	n.status = CalibrationStatus{
+		State:   CalibrationCalibrating,
+		Zone:    roomID,
+		Device:  deviceID,
+		Started: &now,
 	}
+	n.lastProgress = now
+	n.Unlock()
+
+	time.AfterFunc(calibrationTimeout, func() {
+		n.checkCalibration(now)
+	})
+
+	n.log.Infof("Calibrating room %s using device %s", roomID, deviceID)
+
+	payload, _ := json.Marshal(&map[string]string{
+		"zone":   roomID,
+		"device": deviceID,
+	})
+
+	n.Conn.GetMqttClient().Publish("$location/calibrate", payload)
 
 	return nil
 }
 
-// func (n *NinjaLocationManager) GetCalibrationDevice() (<-chan CalibrationDevice, error) {
+// GetCalibrationDevice returns the device with the strongest recent signal, which is
+// the one being held up to the sphere.
+func (n *NinjaLocationManager) GetCalibrationDevice() (*CalibrationDevice, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	var strongest *CalibrationDevice
+
+	for id, reading := range n.rssi {
+		if time.Since(reading.Seen) > rssiWindow {
+			delete(n.rssi, id)
+			continue
+		}
+
+		if strongest == nil || reading.Rssi > strongest.Rssi {
+			strongest = reading
+		}
+	}
+
+	return strongest, nil
+}
+
+func (n *NinjaLocationManager) GetCalibrationProgress() (*CalibrationStatus, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	status := n.status
+	return &status, nil
+}
 
-// 	//$device/:deviceId/:channel/rssi
+// GetCalibrationScores returns the score of the last calibration of each room
+func (n *NinjaLocationManager) GetCalibrationScores() (map[string]float64, error) {
+	conn := n.Pool.Get()
+	defer conn.Close()
 
-// }
+	item, err := redis.Strings(conn.Do("HGETALL", "location:calibration:scores"))
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make(map[string]float64)
+
+	for i := 0; i < len(item); i += 2 {
+		score, err := strconv.ParseFloat(item[i+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad calibration score for room %s: %s", item[i], err)
+		}
+		scores[item[i]] = score
+	}
+
+	return scores, nil
+}
+
+func (n *NinjaLocationManager) deleteScore(zone string) error {
+	conn := n.Pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HDEL", "location:calibration:scores", zone)
+	return err
+}
+
+func (n *NinjaLocationManager) handleRSSI(reading *CalibrationDevice, values map[string]string) bool {
+
+	if reading == nil || reading.Device == "" {
+		return true
+	}
+
+	reading.Seen = time.Now()
+
+	n.Lock()
+	n.rssi[reading.Device] = reading
+	n.Unlock()
 
-func (n *NinjaLocationManager) handRSSI(announcement *json.RawMessage, values map[string]string) bool {
 	return true
 }
 
-func (n *NinjaLocationManager) handleCalibrationProgress(announcement *json.RawMessage, values map[string]string) bool {
+func (n *NinjaLocationManager) handleCalibrationProgress(progress *calibrationProgress, values map[string]string) bool {
+
+	if progress == nil {
+		return true
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	if n.status.State != CalibrationCalibrating || progress.Zone != n.status.Zone {
+		n.log.Debugf("Ignoring calibration progress for zone %s, we are calibrating %s", progress.Zone, n.status.Zone)
+		return true
+	}
+
+	n.status.Progress = progress.Progress
+	n.status.Score = progress.Score
+	n.lastProgress = time.Now()
+
+	if progress.Progress < 1 {
+		return true
+	}
+
+	n.status.State = CalibrationComplete
+
+	n.log.Infof("Calibration of room %s complete. Score: %v", progress.Zone, progress.Score)
+
+	if progress.Score != nil {
+		conn := n.Pool.Get()
+		defer conn.Close()
+
+		if _, err := conn.Do("HSET", "location:calibration:scores", progress.Zone, *progress.Score); err != nil {
+			n.log.Warningf("Failed to save calibration score for room %s error:%s", progress.Zone, err)
+		}
+	}
+
+	return true
+}
+
+// checkCalibration gives up on the calibration started at started if it has stopped reporting
+// progress, so it doesn't stay "calibrating" forever
+func (n *NinjaLocationManager) checkCalibration(started time.Time) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.status.State != CalibrationCalibrating || n.status.Started == nil || !n.status.Started.Equal(started) {
+		// Finished, or replaced by another calibration
+		return
+	}
+
+	if wait := calibrationTimeout - time.Since(n.lastProgress); wait > 0 {
+		time.AfterFunc(wait, func() {
+			n.checkCalibration(started)
+		})
+		return
+	}
+
+	n.log.Warningf("Calibration of room %s using device %s timed out after %s without progress", n.status.Zone, n.status.Device, calibrationTimeout)
+
+	n.status = CalibrationStatus{
+		State:    CalibrationIdle,
+		Zone:     n.status.Zone,
+		Device:   n.status.Device,
+		Progress: n.status.Progress,
+		Started:  n.status.Started,
+		Error:    fmt.Sprintf("No progress reported for %s", calibrationTimeout),
+	}
+}
+
+// handleCalibrationDelete forgets the calibration of a zone, i.e. when a room is deleted
+func (n *NinjaLocationManager) handleCalibrationDelete(request *calibrationDelete, values map[string]string) bool {
+
+	if request == nil || request.Zone == "" {
+		n.log.Warningf("Ignoring calibration delete request without a zone")
+		return true
+	}
+
+	zone := request.Zone
+
+	if err := n.deleteScore(zone); err != nil {
+		n.log.Warningf("Failed to delete calibration score for room %s error:%s", zone, err)
+	}
+
+	n.Lock()
+	if n.status.Zone == zone {
+		n.status = CalibrationStatus{State: CalibrationIdle}
+	}
+	n.Unlock()
+
 	return true
 }
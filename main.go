@@ -12,9 +12,13 @@ import (
 	"github.com/ninjasphere/go-ninja/support"
 	"github.com/ninjasphere/inject"
 	"github.com/ninjasphere/redigo/redis"
+	"github.com/ninjasphere/sphere-go-homecloud/capabilities"
 	"github.com/ninjasphere/sphere-go-homecloud/homecloud"
+	"github.com/ninjasphere/sphere-go-homecloud/location"
 	"github.com/ninjasphere/sphere-go-homecloud/models"
+	"github.com/ninjasphere/sphere-go-homecloud/presence"
 	"github.com/ninjasphere/sphere-go-homecloud/rest"
+	"github.com/ninjasphere/sphere-go-homecloud/solar"
 	"github.com/ninjasphere/sphere-go-homecloud/state"
 )
 
@@ -24,6 +28,10 @@ type postConstructable interface {
 	PostConstruct() error
 }
 
+type stoppable interface {
+	Stop()
+}
+
 const shortForm = "2006-Jan-02"
 
 var epoch, _ = time.Parse(shortForm, "2014-Dec-01")
@@ -99,6 +107,10 @@ func main() {
 	injectables = append(injectables, pool, conn, syncConn)
 	injectables = append(injectables, &homecloud.HomeCloud{}, &homecloud.TimeSeriesManager{}, &homecloud.DeviceManager{}, &homecloud.ModuleManager{})
 	injectables = append(injectables, state.NewStateManager())
+	injectables = append(injectables, capabilities.NewCatalogue())
+	injectables = append(injectables, location.NewLocationManager())
+	injectables = append(injectables, presence.NewPresenceManager())
+	injectables = append(injectables, solar.NewSolarManager())
 	injectables = append(injectables, &rest.RestServer{})
 	injectables = append(injectables, models.GetInjectables()...)
 
@@ -120,5 +132,12 @@ func main() {
 	}
 
 	support.WaitUntilSignal()
+
+	for _, node := range injectables {
+		if n, ok := node.(stoppable); ok {
+			n.Stop()
+		}
+	}
+
 	// So long, and thanks for all the fish.
 }
@@ -48,19 +48,29 @@ func (m *ChannelModel) Delete(deviceID string, channelID string, conn redis.Conn
 
 	_, err = conn.Do("SREM", "device:"+deviceID+":channels", channelID)
 
-	// TODO: announce deletion via MQTT
-	// publish(Ninja.topics.room.goodbye.room(roomId)
-	// publish(Ninja.topics.location.calibration.delete, {zone: roomId})
+	if err == nil {
+		m.sayGoodbye(fmt.Sprintf("$device/%s/channel/%s/event/goodbye", deviceID, channelID), map[string]string{
+			"id":       channelID,
+			"deviceId": deviceID,
+		})
+	}
 
 	return err
 }
 
-func (m *ChannelModel) FetchAll(deviceID string, conn redis.Conn) (*[]*model.Channel, error) {
-	m.syncing.Wait()
+func (m *ChannelModel) FetchIds(deviceID string, conn redis.Conn) ([]string, error) {
 
 	ids, err := redis.Strings(conn.Do("SMEMBERS", "device:"+deviceID+":channels"))
 	m.log.Debugf("Found %d channel id(s) for device %s", len(ids), deviceID)
 
+	return ids, err
+}
+
+func (m *ChannelModel) FetchAll(deviceID string, conn redis.Conn) (*[]*model.Channel, error) {
+	m.syncing.Wait()
+
+	ids, err := m.FetchIds(deviceID, conn)
+
 	if err != nil {
 		return nil, err
 	}
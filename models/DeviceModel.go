@@ -1,8 +1,11 @@
 package models
 
 import (
+	"encoding/json"
 	"fmt"
+	"time"
 
+	"github.com/ninjasphere/go-ninja/config"
 	"github.com/ninjasphere/go-ninja/model"
 	"github.com/ninjasphere/redigo/redis"
 )
@@ -14,6 +17,10 @@ type DeviceModel struct {
 	Channels *ChannelModel `inject:""`
 }
 
+// When set, newly announced devices wait in the pending inbox until they are approved,
+// rather than immediately getting a thing.
+var requireApproval = config.Bool(false, "homecloud.devices.requireApproval")
+
 func NewDeviceModel() *DeviceModel {
 	return &DeviceModel{
 		baseModel: newBaseModel("device", model.Device{}),
@@ -73,6 +80,31 @@ func (m *DeviceModel) Create(device *model.Device, conn redis.Conn) error {
 	m.syncing.Wait()
 	//defer m.sync()
 
+	blacklisted, err := m.IsBlacklisted(device.NaturalID, conn)
+	if err == nil && !blacklisted && device.NaturalID == "" {
+		// Rejected without a natural id, so blacklisted by its device id
+		blacklisted, err = m.IsBlacklisted(device.ID, conn)
+	}
+	if err != nil {
+		return err
+	}
+
+	if blacklisted {
+		m.log.Debugf("Ignoring blacklisted device %s (natural id: %s)", device.ID, device.NaturalID)
+		return nil
+	}
+
+	if requireApproval {
+		exists, err := m.Exists(device.ID, conn)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return m.addPending(device, conn)
+		}
+	}
+
 	m.log.Debugf("Saving device %s", device.ID)
 
 	updated, err := m.save(device.ID, device, conn)
@@ -96,3 +128,257 @@ func (m *DeviceModel) Delete(id string, conn redis.Conn) error {
 	}
 	return err
 }
+
+// -- Pending devices and blacklist --
+
+type PendingDevice struct {
+	Device   *model.Device `json:"device"`
+	Received time.Time     `json:"received"`
+}
+
+type ApproveRequest struct {
+	DeviceID string  `json:"deviceId"`
+	Name     string  `json:"name,omitempty"`
+	Type     string  `json:"type,omitempty"`
+	RoomID   *string `json:"roomId,omitempty"`
+}
+
+func (m *DeviceModel) addPending(device *model.Device, conn redis.Conn) error {
+	defer syncFS()
+
+	m.log.Infof("Device %s (natural id: %s) is awaiting approval", device.ID, device.NaturalID)
+
+	data, err := json.Marshal(&PendingDevice{device, time.Now()})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("HSET", "devices:pending", device.ID, data)
+	return err
+}
+
+func (m *DeviceModel) IsPending(deviceID string, conn redis.Conn) (bool, error) {
+	return redis.Bool(conn.Do("HEXISTS", "devices:pending", deviceID))
+}
+
+// HoldChannel keeps a channel of a pending device until the device is approved, so nothing
+// about it is saved (or synced to the cloud) before then
+func (m *DeviceModel) HoldChannel(deviceID string, channel *model.Channel, conn redis.Conn) error {
+	defer syncFS()
+
+	channel.DeviceID = deviceID
+
+	data, err := json.Marshal(channel)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("HSET", "devices:pending:"+deviceID+":channels", channel.ID, data)
+	return err
+}
+
+// saveHeldChannels saves the channels held while a device was pending
+func (m *DeviceModel) saveHeldChannels(deviceID string, conn redis.Conn) error {
+	items, err := redis.Strings(conn.Do("HVALS", "devices:pending:"+deviceID+":channels"))
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		channel := &model.Channel{}
+		if err := json.Unmarshal([]byte(item), channel); err != nil {
+			m.log.Warningf("Dropping unreadable held channel of device %s error:%s", deviceID, err)
+			continue
+		}
+
+		if err := m.Channels.Create(deviceID, channel, conn); err != nil {
+			return fmt.Errorf("Failed to save channel %s of approved device %s error:%s", channel.ID, deviceID, err)
+		}
+	}
+
+	_, err = conn.Do("DEL", "devices:pending:"+deviceID+":channels")
+	return err
+}
+
+func (m *DeviceModel) FetchPending(deviceID string, conn redis.Conn) (*PendingDevice, error) {
+
+	item, err := conn.Do("HGET", "devices:pending", deviceID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil {
+		return nil, RecordNotFound
+	}
+
+	data, err := redis.Bytes(item, err)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := &PendingDevice{}
+	if err := json.Unmarshal(data, pending); err != nil {
+		return nil, fmt.Errorf("Failed to parse pending device %s error:%s", deviceID, err)
+	}
+
+	return pending, nil
+}
+
+func (m *DeviceModel) FetchAllPending(conn redis.Conn) (*[]*PendingDevice, error) {
+
+	ids, err := redis.Strings(conn.Do("HKEYS", "devices:pending"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]*PendingDevice, len(ids))
+
+	for i, id := range ids {
+		devices[i], err = m.FetchPending(id, conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &devices, nil
+}
+
+// Approve saves a pending device, and creates its thing with the requested name, type and room.
+func (m *DeviceModel) Approve(r *ApproveRequest, conn redis.Conn) (*model.Thing, error) {
+	m.syncing.Wait()
+
+	pending, err := m.FetchPending(r.DeviceID, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	device := pending.Device
+
+	if _, err := m.save(device.ID, device, conn); err != nil {
+		return nil, err
+	}
+
+	if err := m.saveHeldChannels(device.ID, conn); err != nil {
+		return nil, err
+	}
+
+	if err := m.Things.ensureThingForDevice(device, conn); err != nil {
+		return nil, err
+	}
+
+	thing, err := m.Things.FetchByDeviceId(device.ID, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Name != "" {
+		thing.Name = r.Name
+	}
+	if r.Type != "" {
+		thing.Type = r.Type
+	}
+	thing.Promoted = true
+
+	if err := m.Things.Update(thing.ID, thing, conn); err != nil {
+		return nil, err
+	}
+
+	if r.RoomID != nil {
+		if err := m.Things.SetLocation(thing.ID, r.RoomID, conn); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only once everything else is done, so a failed approval can be approved (or rejected) again
+	if _, err := conn.Do("HDEL", "devices:pending", device.ID); err != nil {
+		return nil, err
+	}
+
+	return m.Things.Fetch(thing.ID, conn)
+}
+
+// Reject removes a pending device, and blacklists its natural id so future announcements are ignored.
+// A device without a natural id is blacklisted by its device id instead.
+func (m *DeviceModel) Reject(deviceID string, conn redis.Conn) error {
+	m.syncing.Wait()
+	defer syncFS()
+
+	pending, err := m.FetchPending(deviceID, conn)
+	if err != nil {
+		return err
+	}
+
+	naturalID := pending.Device.NaturalID
+	if naturalID == "" {
+		naturalID = deviceID
+	}
+
+	m.log.Infof("Rejecting device %s, natural id %s will be ignored", deviceID, naturalID)
+
+	conn.Send("MULTI")
+	conn.Send("HDEL", "devices:pending", deviceID)
+	conn.Send("DEL", "devices:pending:"+deviceID+":channels")
+	conn.Send("HSET", "devices:blacklist", naturalID, deviceID)
+	conn.Send("SADD", "devices:blacklistedIds", deviceID)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return err
+	}
+
+	// Channels of pending devices are held rather than saved, but ones announced before that
+	// was the case may have been saved.
+	channels, err := m.Channels.FetchIds(deviceID, conn)
+	if err != nil {
+		return err
+	}
+
+	for _, channelID := range channels {
+		if err := m.Channels.Delete(deviceID, channelID, conn); err != nil {
+			m.log.Warningf("Failed to delete channel %s of rejected device %s error:%s", channelID, deviceID, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *DeviceModel) IsBlacklisted(naturalID string, conn redis.Conn) (bool, error) {
+	if naturalID == "" {
+		return false, nil
+	}
+	return redis.Bool(conn.Do("HEXISTS", "devices:blacklist", naturalID))
+}
+
+// IsBlacklistedDevice checks by device id rather than natural id, for announcements (like
+// channels) that don't carry the natural id.
+// devices:blacklistedIds is a reverse index of devices:blacklist, so channel announcements don't
+// have to scan it.
+func (m *DeviceModel) IsBlacklistedDevice(deviceID string, conn redis.Conn) (bool, error) {
+	return redis.Bool(conn.Do("SISMEMBER", "devices:blacklistedIds", deviceID))
+}
+
+// Unblacklist allows a previously rejected device to be announced again. A device rejected
+// without a natural id is unblacklisted by its device id.
+func (m *DeviceModel) Unblacklist(naturalID string, conn redis.Conn) error {
+	defer syncFS()
+
+	item, err := conn.Do("HGET", "devices:blacklist", naturalID)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return RecordNotFound
+	}
+
+	deviceID, err := redis.String(item, nil)
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("HDEL", "devices:blacklist", naturalID)
+	conn.Send("SREM", "devices:blacklistedIds", deviceID)
+	_, err = conn.Do("EXEC")
+
+	return err
+}
@@ -0,0 +1,348 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/ninjasphere/go-ninja/config"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/redigo/redis"
+)
+
+// Floor groups rooms, i.e. "Ground floor" or "Garden". Rooms are kept in display order,
+// and a room can only be on one floor.
+type Floor struct {
+	ID     string   `json:"id" redis:"id"`
+	SiteID string   `json:"siteId" redis:"siteId"`
+	Name   string   `json:"name" redis:"name"`
+	Type   string   `json:"type" redis:"type"` // "floor" or "area"
+	Order  int      `json:"order" redis:"order"`
+	Rooms  []string `json:"rooms" redis:"rooms,json"`
+}
+
+type FloorModel struct {
+	baseModel
+
+	RoomModel *RoomModel `inject:""`
+}
+
+func toFloor(obj interface{}) *Floor {
+	var floor, ok = obj.(*Floor)
+	if !ok {
+		panic("Non-'Floor' passed to a FloorModel handler")
+	}
+	return floor
+}
+
+func NewFloorModel() *FloorModel {
+
+	floorModel := &FloorModel{
+		baseModel: newBaseModel("floor", Floor{}),
+	}
+
+	floorModel.baseModel.afterSave = func(obj interface{}, conn redis.Conn) error {
+		return floorModel.afterSave(toFloor(obj), conn)
+	}
+
+	return floorModel
+}
+
+func (m *FloorModel) Create(floor *Floor, conn redis.Conn) error {
+	m.syncing.Wait()
+
+	if floor.ID == "" {
+		if uuid, err := uuid.NewRandom(); err != nil {
+			return err
+		} else {
+			floor.ID = uuid.String()
+		}
+	}
+
+	if floor.SiteID == "" {
+		floor.SiteID = config.MustString("siteId")
+	}
+
+	if floor.Type == "" {
+		floor.Type = "floor"
+	}
+
+	if floor.Rooms == nil {
+		floor.Rooms = []string{}
+	}
+
+	_, err := m.save(floor.ID, floor, conn)
+	return err
+}
+
+func (m *FloorModel) Fetch(id string, conn redis.Conn) (*Floor, error) {
+	m.syncing.Wait()
+
+	floor := &Floor{}
+
+	if err := m.fetch(id, floor, false, conn); err != nil {
+		return nil, err
+	}
+
+	if floor.Rooms == nil {
+		floor.Rooms = []string{}
+	}
+
+	return floor, nil
+}
+
+// FetchAll returns all floors, in order
+func (m *FloorModel) FetchAll(conn redis.Conn) (*[]*Floor, error) {
+	m.syncing.Wait()
+
+	ids, err := m.fetchIds(conn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	floors := make([]*Floor, len(ids))
+
+	for i, id := range ids {
+		floors[i], err = m.Fetch(id, conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Sort(byOrder(floors))
+
+	return &floors, nil
+}
+
+// Update changes the name, type and order of a floor. Rooms are changed with SetRooms.
+func (m *FloorModel) Update(id string, floor *Floor, conn redis.Conn) error {
+	m.syncing.Wait()
+
+	oldFloor, err := m.Fetch(id, conn)
+	if err != nil {
+		return err
+	}
+
+	oldFloor.Name = floor.Name
+	oldFloor.Type = floor.Type
+	oldFloor.Order = floor.Order
+
+	if _, err := m.save(id, oldFloor, conn); err != nil {
+		return fmt.Errorf("Failed to update floor (id:%s): %s", id, err)
+	}
+
+	return nil
+}
+
+// SetRooms replaces the rooms on a floor, in the order given. Rooms are taken off any
+// other floor they were on.
+func (m *FloorModel) SetRooms(id string, roomIDs []string, conn redis.Conn) error {
+	m.syncing.Wait()
+
+	floor, err := m.Fetch(id, conn)
+	if err != nil {
+		return err
+	}
+
+	// A room listed twice keeps its first place
+	rooms := []string{}
+	seen := make(map[string]bool)
+
+	for _, roomID := range roomIDs {
+		if seen[roomID] {
+			continue
+		}
+		seen[roomID] = true
+
+		if _, err := m.RoomModel.Fetch(roomID, conn); err != nil {
+			return fmt.Errorf("Failed to fetch room %s error: %s", roomID, err)
+		}
+
+		rooms = append(rooms, roomID)
+	}
+
+	floor.Rooms = rooms
+
+	_, err = m.save(id, floor, conn)
+	return err
+}
+
+func (m *FloorModel) Delete(id string, conn redis.Conn) error {
+	m.syncing.Wait()
+
+	return m.delete(id, conn)
+}
+
+// FetchRooms returns the rooms on a floor, in order
+func (m *FloorModel) FetchRooms(id string, conn redis.Conn) (*[]*model.Room, error) {
+
+	floor, err := m.Fetch(id, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := []*model.Room{}
+
+	for _, roomID := range floor.Rooms {
+		room, err := m.RoomModel.Fetch(roomID, conn)
+		if err == RecordNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+
+	return &rooms, nil
+}
+
+// Actuate calls a method on a channel protocol of every thing, in every room on the floor.
+// The results are keyed by thing id.
+func (m *FloorModel) Actuate(id string, protocol string, method string, params *json.RawMessage, conn redis.Conn) (map[string]*ActuationResult, error) {
+
+	floor, err := m.Fetch(id, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]*ActuationResult)
+
+	for _, roomID := range floor.Rooms {
+		roomResults, err := m.RoomModel.Actuate(roomID, protocol, method, params, conn)
+		if err != nil {
+			m.log.Warningf("Failed to actuate room %s on floor %s. error: %s", roomID, id, err)
+			continue
+		}
+
+		for thingID, result := range roomResults {
+			results[thingID] = result
+		}
+	}
+
+	return results, nil
+}
+
+// FetchFloorForRoom returns the floor a room is on, or RecordNotFound
+func (m *FloorModel) FetchFloorForRoom(roomID string, conn redis.Conn) (*Floor, error) {
+
+	floors, err := m.FetchAll(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, floor := range *floors {
+		for _, id := range floor.Rooms {
+			if id == roomID {
+				return floor, nil
+			}
+		}
+	}
+
+	return nil, RecordNotFound
+}
+
+// removeRoom takes a room off whichever floor it is on, i.e. when the room is deleted
+func (m *FloorModel) removeRoom(roomID string, conn redis.Conn) error {
+
+	floor, err := m.FetchFloorForRoom(roomID, conn)
+	if err == RecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	floor.Rooms = without(floor.Rooms, roomID)
+
+	_, err = m.save(floor.ID, floor, conn)
+	return err
+}
+
+// afterSave makes sure none of this floor's rooms are also on another floor. The other floors'
+// rooms are updated directly, rather than saving each of them again.
+func (m *FloorModel) afterSave(floor *Floor, conn redis.Conn) error {
+
+	moved := make(map[string]bool)
+	for _, roomID := range floor.Rooms {
+		moved[roomID] = true
+	}
+
+	ids, err := m.fetchIds(conn)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if id == floor.ID {
+			continue
+		}
+
+		item, err := conn.Do("HGET", "floor:"+id, "rooms")
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			continue
+		}
+
+		data, err := redis.Bytes(item, nil)
+		if err != nil {
+			return err
+		}
+
+		rooms := []string{}
+		if err := json.Unmarshal(data, &rooms); err != nil {
+			return fmt.Errorf("Failed to parse rooms of floor %s error: %s", id, err)
+		}
+
+		remaining := []string{}
+		for _, roomID := range rooms {
+			if !moved[roomID] {
+				remaining = append(remaining, roomID)
+			}
+		}
+
+		if len(remaining) == len(rooms) {
+			continue
+		}
+
+		m.log.Debugf("Moving rooms from floor %s to floor %s", id, floor.ID)
+
+		if data, err = json.Marshal(remaining); err != nil {
+			return err
+		}
+
+		if _, err := conn.Do("HSET", "floor:"+id, "rooms", data); err != nil {
+			return err
+		}
+
+		if m.sendEvent != nil {
+			m.sendEvent("updated", id)
+		}
+
+		if err := m.recordChange(id, "update", "local", conn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func without(ids []string, id string) []string {
+	remaining := []string{}
+	for _, x := range ids {
+		if x != id {
+			remaining = append(remaining, x)
+		}
+	}
+	return remaining
+}
+
+type byOrder []*Floor
+
+func (a byOrder) Len() int           { return len(a) }
+func (a byOrder) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byOrder) Less(i, j int) bool { return a[i].Order < a[j].Order }
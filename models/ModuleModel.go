@@ -1,51 +1,152 @@
 package models
 
 import (
+	"encoding/json"
+
 	"github.com/ninjasphere/go-ninja/model"
 	"github.com/ninjasphere/redigo/redis"
 )
 
-// TODO: Sync module config
+// SyncedModule is a module as it is synced with the cloud, along with its config. A config
+// flagged as secret is left out, or sent as EncryptedConfig if homecloud.sync.secretKey is set.
+type SyncedModule struct {
+	ID              string           `json:"id" redis:"id"`
+	Name            string           `json:"name" redis:"name"`
+	Version         string           `json:"version" redis:"version"`
+	Description     string           `json:"description" redis:"description"`
+	ConfigSecret    bool             `json:"configSecret" redis:"configSecret"`
+	Config          *json.RawMessage `json:"config,omitempty" redis:"-"`
+	EncryptedConfig string           `json:"encryptedConfig,omitempty" redis:"-"`
+}
 
 type ModuleModel struct {
 	baseModel
 }
 
+func toSyncedModule(obj interface{}) *SyncedModule {
+	var module, ok = obj.(*SyncedModule)
+	if !ok {
+		panic("Non-'SyncedModule' passed to a ModuleModel handler")
+	}
+	return module
+}
+
 func NewModuleModel() *ModuleModel {
 	model := &ModuleModel{
-		baseModel: newBaseModel("module", model.Module{}),
+		baseModel: newBaseModel("module", SyncedModule{}),
 	}
 	model.sendEvent = func(event string, payload interface{}) error {
 		// Not currently exposed as a service
 		return nil
 	}
+
+	// The config is kept in the module's hash, but isn't one of its fields
+	model.baseModel.onFetch = func(obj interface{}, syncing bool, conn redis.Conn) error {
+		return model.onFetch(toSyncedModule(obj), syncing, conn)
+	}
+	model.baseModel.afterSave = func(obj interface{}, conn redis.Conn) error {
+		return model.afterSave(toSyncedModule(obj), conn)
+	}
+	model.baseModel.unchanged = func(existing interface{}, obj interface{}) bool {
+		a, b := toSyncedModule(existing), toSyncedModule(obj)
+		return model.isUnchanged(a, b) && sameConfig(a.Config, b.Config) && a.EncryptedConfig == b.EncryptedConfig
+	}
+
 	return model
 }
 
+func (m *ModuleModel) onFetch(module *SyncedModule, syncing bool, conn redis.Conn) error {
+	config, err := m.getConfig(module.ID, conn)
+	if err != nil || config == nil {
+		return err
+	}
+
+	raw := json.RawMessage(*config)
+	module.Config = &raw
+
+	if syncing && module.ConfigSecret {
+		module.Config = nil
+
+		if encrypted, err := encryptSecret([]byte(raw)); err != nil {
+			m.log.Warningf("Failed to encrypt secret config of module %s, not syncing it. error: %s", module.ID, err)
+		} else {
+			// Empty if there's no key, so the config stays local
+			module.EncryptedConfig = encrypted
+		}
+	}
+
+	return nil
+}
+
+// afterSave stores the config that came with a module. A module from the cloud without one (i.e.
+// because it was secret) leaves ours alone.
+func (m *ModuleModel) afterSave(module *SyncedModule, conn redis.Conn) error {
+	var config []byte
+
+	if module.Config != nil {
+		config = []byte(*module.Config)
+	} else if module.EncryptedConfig != "" {
+		var err error
+		if config, err = decryptSecret(module.EncryptedConfig); err != nil {
+			m.log.Warningf("Failed to decrypt secret config of module %s, keeping ours. error: %s", module.ID, err)
+			return nil
+		}
+	}
+
+	if config == nil {
+		return nil
+	}
+
+	_, err := conn.Do("HSET", "module:"+module.ID, "config", string(config))
+	return err
+}
+
 func (m *ModuleModel) Fetch(id string, conn redis.Conn) (*model.Module, error) {
 	m.syncing.Wait()
 	//defer m.sync()
 
-	module := &model.Module{}
+	module := &SyncedModule{}
 
 	if err := m.fetch(id, module, false, conn); err != nil {
 		return nil, err
 	}
 
-	return module, nil
+	return &model.Module{
+		ID:          module.ID,
+		Name:        module.Name,
+		Version:     module.Version,
+		Description: module.Description,
+	}, nil
 }
 
 func (m *ModuleModel) Create(module *model.Module, conn redis.Conn) error {
 	m.syncing.Wait()
 	//defer m.sync()
 
-	_, err := m.save(module.ID, module, conn)
+	synced := &SyncedModule{}
+
+	// Announcements don't include the config (or whether it's secret), so keep what we have
+	err := m.fetch(module.ID, synced, false, conn)
+	if err != nil && err != RecordNotFound {
+		return err
+	}
+
+	synced.ID = module.ID
+	synced.Name = module.Name
+	synced.Version = module.Version
+	synced.Description = module.Description
+
+	_, err = m.save(module.ID, synced, conn)
 	return err
 }
 
 func (m *ModuleModel) GetConfig(moduleID string, conn redis.Conn) (*string, error) {
 	m.syncing.Wait()
 
+	return m.getConfig(moduleID, conn)
+}
+
+func (m *ModuleModel) getConfig(moduleID string, conn redis.Conn) (*string, error) {
 	exists, err := redis.Bool(conn.Do("HEXISTS", "module:"+moduleID, "config"))
 
 	if exists {
@@ -74,7 +175,41 @@ func (m *ModuleModel) SetConfig(moduleID string, config string, conn redis.Conn)
 	//defer m.sync()
 	defer syncFS()
 
-	_, err := conn.Do("HSET", "module:"+moduleID, "config", config)
+	module := &SyncedModule{}
+
+	err := m.fetch(moduleID, module, false, conn)
+	if err != nil && err != RecordNotFound {
+		return err
+	}
+
+	var v interface{}
+	if err == RecordNotFound || json.Unmarshal([]byte(config), &v) != nil {
+		// We can't sync it until the module has announced itself (or while it isn't JSON)
+		_, err = conn.Do("HSET", "module:"+moduleID, "config", config)
+		return err
+	}
+
+	raw := json.RawMessage(config)
+	module.Config = &raw
+
+	_, err = m.save(moduleID, module, conn)
+	return err
+}
+
+// SetConfigSecret flags a module's config as containing secrets (i.e. passwords or access
+// tokens). Secret configs are only synced if they can be encrypted with homecloud.sync.secretKey.
+func (m *ModuleModel) SetConfigSecret(moduleID string, secret bool, conn redis.Conn) error {
+	m.syncing.Wait()
+
+	module := &SyncedModule{}
+
+	if err := m.fetch(moduleID, module, false, conn); err != nil {
+		return err
+	}
+
+	module.ConfigSecret = secret
+
+	_, err := m.save(moduleID, module, conn)
 	return err
 }
 
@@ -84,5 +219,24 @@ func (m *ModuleModel) DeleteConfig(moduleID string, conn redis.Conn) error {
 	defer syncFS()
 
 	_, err := conn.Do("HDEL", "module:"+moduleID, "config")
-	return err
+	if err != nil {
+		return err
+	}
+
+	module := &SyncedModule{}
+
+	if err := m.fetch(moduleID, module, false, conn); err != nil {
+		// Already deleted along with the module, or never announced
+		return nil
+	}
+
+	// The config isn't saved through save(), so record the change here
+	return m.recordChange(moduleID, "update", "local", conn)
+}
+
+func sameConfig(a, b *json.RawMessage) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return string(*a) == string(*b)
 }
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/logger"
+	"github.com/ninjasphere/redigo/redis"
+)
+
+// QuarantinedAnnouncement is a device or channel announcement that failed validation.
+// It's kept along with the reason it was rejected, so it can be inspected, retried or discarded.
+type QuarantinedAnnouncement struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"` // "device" or "channel"
+	DeviceID  string          `json:"deviceId"`
+	ChannelID string          `json:"channelId,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+	Error     string          `json:"error"`
+	Received  time.Time       `json:"received"`
+}
+
+// QuarantineModel stores rejected announcements. It is local only, and never synced.
+type QuarantineModel struct {
+	log   *logger.Logger
+	retry func(item *QuarantinedAnnouncement, conn redis.Conn) error
+}
+
+func NewQuarantineModel() *QuarantineModel {
+	return &QuarantineModel{
+		log: logger.GetLogger("QuarantineModel"),
+	}
+}
+
+// QuarantineID returns the id an announcement is quarantined under. A newer announcement
+// from the same device or channel replaces the previous one. Device and channel ids are
+// topic levels, so they can't contain "+" (an MQTT wildcard) and it can separate them.
+func QuarantineID(deviceID string, channelID *string) string {
+	if channelID == nil {
+		return "device:" + deviceID
+	}
+	return "channel:" + deviceID + "+" + *channelID
+}
+
+// SetRetryHandler sets the function used to reprocess an announcement when it is retried.
+func (m *QuarantineModel) SetRetryHandler(handler func(item *QuarantinedAnnouncement, conn redis.Conn) error) {
+	m.retry = handler
+}
+
+func (m *QuarantineModel) Add(item *QuarantinedAnnouncement, conn redis.Conn) error {
+	defer syncFS()
+
+	m.log.Infof("Quarantining %s error:%s", item.ID, item.Error)
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("HSET", "quarantine", item.ID, data)
+	return err
+}
+
+func (m *QuarantineModel) Fetch(id string, conn redis.Conn) (*QuarantinedAnnouncement, error) {
+
+	item, err := conn.Do("HGET", "quarantine", id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil {
+		return nil, RecordNotFound
+	}
+
+	data, err := redis.Bytes(item, err)
+	if err != nil {
+		return nil, err
+	}
+
+	announcement := &QuarantinedAnnouncement{}
+	if err := json.Unmarshal(data, announcement); err != nil {
+		return nil, fmt.Errorf("Failed to parse quarantined announcement %s error:%s", id, err)
+	}
+
+	return announcement, nil
+}
+
+func (m *QuarantineModel) FetchAll(conn redis.Conn) (*[]*QuarantinedAnnouncement, error) {
+
+	ids, err := redis.Strings(conn.Do("HKEYS", "quarantine"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*QuarantinedAnnouncement, len(ids))
+
+	for i, id := range ids {
+		items[i], err = m.Fetch(id, conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &items, nil
+}
+
+// Discard removes a quarantined announcement without processing it
+func (m *QuarantineModel) Discard(id string, conn redis.Conn) error {
+	defer syncFS()
+
+	removed, err := redis.Int(conn.Do("HDEL", "quarantine", id))
+
+	if err == nil && removed == 0 {
+		return RecordNotFound
+	}
+
+	return err
+}
+
+// Retry processes a quarantined announcement again, and removes it once that succeeds. If it
+// is still invalid it is quarantined again, and if it fails for any other reason it is kept.
+func (m *QuarantineModel) Retry(id string, conn redis.Conn) error {
+
+	if m.retry == nil {
+		return fmt.Errorf("No retry handler has been set")
+	}
+
+	item, err := m.Fetch(id, conn)
+	if err != nil {
+		return err
+	}
+
+	if err := m.retry(item, conn); err != nil {
+		return err
+	}
+
+	// A valid announcement normally clears its own quarantine
+	if err := m.Discard(id, conn); err != nil && err != RecordNotFound {
+		return err
+	}
+
+	return nil
+}
@@ -1,10 +1,15 @@
 package models
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/ninjasphere/go-ninja/config"
 	"github.com/ninjasphere/go-ninja/model"
 	"github.com/ninjasphere/redigo/redis"
 )
@@ -14,6 +19,7 @@ type RoomModel struct {
 
 	SiteModel  *SiteModel  `inject:""`
 	ThingModel *ThingModel `inject:""`
+	FloorModel *FloorModel `inject:""`
 	Pool       *redis.Pool `inject:""`
 }
 
@@ -124,6 +130,123 @@ func (m *RoomModel) Delete(id string, conn redis.Conn) error {
 	return m.delete(id, conn)
 }
 
+var InvalidRoomDeletePolicy = errors.New("Invalid room deletion policy")
+
+// RoomDeletePolicy says what happens to the things in a room when it is deleted.
+// Policy is one of "unassign" (the default), "move" (to RoomID) or "default" (to the site's default room).
+type RoomDeletePolicy struct {
+	Policy string `json:"policy"`
+	RoomID string `json:"roomId,omitempty"`
+}
+
+// RoomDeletion reports what happened to each of the things in a deleted room
+type RoomDeletion struct {
+	ID     string             `json:"id"`
+	Policy string             `json:"policy"`
+	RoomID *string            `json:"roomId,omitempty"`
+	Things []*ThingRelocation `json:"things"`
+}
+
+// ThingRelocation is the outcome for a single thing. Action is "moved", "unassigned" or "failed".
+type ThingRelocation struct {
+	ThingID    string  `json:"thingId"`
+	Name       string  `json:"name"`
+	Action     string  `json:"action"`
+	RoomID     *string `json:"roomId,omitempty"`
+	Unpromoted bool    `json:"unpromoted"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// DeleteWithPolicy deletes a room after moving or un-assigning its things, as the policy says.
+// The room is still deleted if individual things fail to move; those are reported as "failed"
+// and are un-assigned along with the room.
+func (m *RoomModel) DeleteWithPolicy(id string, policy *RoomDeletePolicy, conn redis.Conn) (*RoomDeletion, error) {
+	m.syncing.Wait()
+
+	if _, err := m.Fetch(id, conn); err != nil {
+		return nil, err
+	}
+
+	if policy == nil || policy.Policy == "" {
+		policy = &RoomDeletePolicy{Policy: "unassign"}
+	}
+
+	deletion := &RoomDeletion{
+		ID:     id,
+		Policy: policy.Policy,
+		Things: []*ThingRelocation{},
+	}
+
+	switch policy.Policy {
+	case "unassign":
+	case "move":
+		if policy.RoomID == "" || policy.RoomID == id {
+			return nil, InvalidRoomDeletePolicy
+		}
+		if _, err := m.Fetch(policy.RoomID, conn); err != nil {
+			m.log.Warningf("Can't move things from room %s to room %s. error: %s", id, policy.RoomID, err)
+			return nil, InvalidRoomDeletePolicy
+		}
+		deletion.RoomID = &policy.RoomID
+	case "default":
+		roomID, err := m.ensureDefaultRoom(conn)
+		if err != nil {
+			return nil, err
+		}
+		if roomID == id {
+			// Deleting the default room itself, there's nowhere to move things to
+			return nil, InvalidRoomDeletePolicy
+		}
+		deletion.RoomID = &roomID
+	default:
+		return nil, InvalidRoomDeletePolicy
+	}
+
+	thingIds, err := redis.Strings(conn.Do("SMEMBERS", fmt.Sprintf("room:%s:things", id)))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, thingID := range thingIds {
+		thing, err := m.ThingModel.Fetch(thingID, conn)
+		if err != nil {
+			// We were out of sync, the thing is already gone
+			m.log.Infof("Failed to fetch thing %s in room %s being deleted. error: %s", thingID, id, err)
+			continue
+		}
+
+		relocation := &ThingRelocation{
+			ThingID: thingID,
+			Name:    thing.Name,
+		}
+
+		if deletion.RoomID != nil {
+			relocation.Action = "moved"
+			relocation.RoomID = deletion.RoomID
+		} else {
+			relocation.Action = "unassigned"
+			relocation.Unpromoted = thing.Promoted
+		}
+
+		if err := m.ThingModel.SetLocation(thingID, deletion.RoomID, conn); err != nil {
+			m.log.Warningf("Failed to relocate thing %s from deleted room %s. error: %s", thingID, id, err)
+			relocation.Action = "failed"
+			relocation.RoomID = nil
+			relocation.Unpromoted = thing.Promoted
+			relocation.Error = err.Error()
+		}
+
+		deletion.Things = append(deletion.Things, relocation)
+	}
+
+	// Anything left in the room (i.e. failures) is un-assigned by afterDelete
+	if err := m.delete(id, conn); err != nil {
+		return nil, err
+	}
+
+	return deletion, nil
+}
+
 func (m *RoomModel) afterDelete(deletedRoom *model.Room, conn redis.Conn) error {
 
 	defer syncFS()
@@ -146,6 +269,15 @@ func (m *RoomModel) afterDelete(deletedRoom *model.Room, conn redis.Conn) error
 
 	_, err = conn.Do("DEL", fmt.Sprintf("room:%s:things", deletedRoom.ID))
 
+	if err := m.FloorModel.removeRoom(deletedRoom.ID, conn); err != nil {
+		m.log.Warningf("Failed to remove deleted room %s from its floor. error: %s", deletedRoom.ID, err)
+	}
+
+	m.sayGoodbye(fmt.Sprintf("$room/%s/event/goodbye", deletedRoom.ID), map[string]string{"id": deletedRoom.ID})
+
+	// The location service no longer needs the calibration for this zone
+	m.sayGoodbye("$location/calibration/delete", map[string]string{"zone": deletedRoom.ID})
+
 	return err
 }
 
@@ -181,7 +313,7 @@ func (m *RoomModel) MoveThing(from *string, to *string, thing string, conn redis
 	} else if from != nil && to == nil {
 		// we need to remove it
 
-		src := "room:" + *from + "s:things"
+		src := "room:" + *from + ":things"
 
 		m.log.Debugf("Removing thing %s from room %s", thing, *from)
 		_, err = conn.Do("SREM", src, thing)
@@ -189,7 +321,7 @@ func (m *RoomModel) MoveThing(from *string, to *string, thing string, conn redis
 	} else {
 		// need to move it
 
-		src := "room:" + *from + "s:things"
+		src := "room:" + *from + ":things"
 		dest := "room:" + *to + ":things"
 
 		m.log.Debugf("Moving thing %s from room %s to room %s", thing, *from, *to)
@@ -210,6 +342,81 @@ func (m *RoomModel) MoveThing(from *string, to *string, thing string, conn redis
 
 }
 
+var actuationTimeout = config.Duration(time.Second*10, "homecloud.actuation.timeout")
+
+// ActuationResult is the reply from a single thing to a room-wide actuation
+type ActuationResult struct {
+	ThingID   string           `json:"thingId"`
+	DeviceID  string           `json:"deviceId"`
+	ChannelID string           `json:"channelId"`
+	Reply     *json.RawMessage `json:"reply,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// Actuate calls a method on every channel with the given protocol, on every thing in a room.
+// Things without a matching channel are skipped. The results are keyed by thing id.
+func (m *RoomModel) Actuate(roomID string, protocol string, method string, params *json.RawMessage, conn redis.Conn) (map[string]*ActuationResult, error) {
+	m.syncing.Wait()
+
+	if _, err := m.Fetch(roomID, conn); err != nil {
+		return nil, err
+	}
+
+	thingIds, err := redis.Strings(conn.Do("SMEMBERS", fmt.Sprintf("room:%s:things", roomID)))
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]*ActuationResult)
+
+	for _, id := range thingIds {
+		thing, err := m.ThingModel.Fetch(id, conn)
+		if err != nil {
+			m.log.Warningf("Failed to fetch thing %s in room %s for actuation. error: %s", id, roomID, err)
+			continue
+		}
+
+		if thing.Device == nil || thing.Device.Channels == nil {
+			continue
+		}
+
+		for _, channel := range *thing.Device.Channels {
+			if channel.Protocol == protocol {
+				results[thing.ID] = &ActuationResult{
+					ThingID:   thing.ID,
+					DeviceID:  thing.Device.ID,
+					ChannelID: channel.ID,
+				}
+				break
+			}
+		}
+	}
+
+	m.log.Infof("Actuating %s.%s on %d thing(s) in room %s", protocol, method, len(results), roomID)
+
+	var wg sync.WaitGroup
+	wg.Add(len(results))
+
+	for _, result := range results {
+		go func(result *ActuationResult) {
+			defer wg.Done()
+
+			var reply json.RawMessage
+			client := m.Conn.GetServiceClient(fmt.Sprintf("$device/%s/channel/%s", result.DeviceID, result.ChannelID))
+
+			if err := client.Call(method, params, &reply, actuationTimeout); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Reply = &reply
+			}
+		}(result)
+	}
+
+	wg.Wait()
+
+	return results, nil
+}
+
 //
 // This procedure checks that that the current site has a default room
 // and, if not, creates one then updates the site to record the identity
@@ -238,15 +445,15 @@ func (m *RoomModel) ensureDefaultRoom(conn redis.Conn) (string, error) {
 			}
 
 			if err := m.Create(room, conn); err != nil {
-				log.Println("failed to create room: %v", err)
+				log.Printf("failed to create room: %v", err)
 				return "", err
 			}
 
 			site.DefaultRoomID = &room.ID
-			log.Println("created default room id: %s", room.ID)
+			log.Printf("created default room id: %s", room.ID)
 
 			if err := m.SiteModel.Update(site.ID, site, conn); err != nil {
-				log.Println("failed to update site: %v", err)
+				log.Printf("failed to update site: %v", err)
 				return "", err
 			} else {
 				return room.ID, nil
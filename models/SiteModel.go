@@ -1,11 +1,8 @@
 package models
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"time"
 
 	"github.com/ninjasphere/go-ninja/config"
 	"github.com/ninjasphere/go-ninja/model"
@@ -35,9 +32,27 @@ func (m *SiteModel) Fetch(id string, conn redis.Conn) (*model.Site, error) {
 		return nil, err
 	}
 
+	m.currentOffset(site)
+
 	return site, nil
 }
 
+// currentOffset sets the offset of a site's timezone as it is now, as it changes with DST. It isn't
+// saved, so reading a site never writes to it.
+func (m *SiteModel) currentOffset(site *model.Site) {
+	if site.TimeZoneID == nil || *site.TimeZoneID == "" {
+		return
+	}
+
+	tz, err := getTimezoneAt(*site.TimeZoneID, time.Now())
+	if err != nil {
+		m.log.Warningf("Failed to calculate offset of site %s: %s", site.ID, err)
+		return
+	}
+
+	site.TimeZoneOffset = &tz.Offset
+}
+
 func (m *SiteModel) FetchAll(conn redis.Conn) (*[]*model.Site, error) {
 	m.syncing.Wait()
 
@@ -119,14 +134,15 @@ func (m *SiteModel) Update(id string, site *model.Site, conn redis.Conn) error {
 
 		tz, err := getTimezone(*site.Latitude, *site.Longitude)
 		if err != nil {
-			return fmt.Errorf("Failed to get timezone: %s", err)
+			// i.e. out at sea. Keep whatever timezone we had rather than failing the update.
+			m.log.Warningf("Failed to get timezone, leaving it unchanged: %s", err)
 		} else {
-			m.log.Debugf("Timezone (%0.4f, %0.4f) -> %v", *site.Latitude, *site.Longitude, tz)
-		}
+			m.log.Debugf("Timezone (%0.4f, %0.4f) -> %+v", *site.Latitude, *site.Longitude, tz)
 
-		oldSite.TimeZoneID = tz.TimeZoneID
-		oldSite.TimeZoneName = tz.TimeZoneName
-		oldSite.TimeZoneOffset = tz.RawOffset // TODO: Not handling DST. Worth even having?
+			oldSite.TimeZoneID = &tz.TimeZoneID
+			oldSite.TimeZoneName = &tz.TimeZoneName
+			oldSite.TimeZoneOffset = &tz.Offset
+		}
 	} else {
 		m.log.Debugf("no change to latitude or longitude")
 	}
@@ -137,51 +153,3 @@ func (m *SiteModel) Update(id string, site *model.Site, conn redis.Conn) error {
 
 	return nil
 }
-
-type googleTimezone struct {
-	DstOffset    *int    `json:"dstOffset,omitempty"`
-	RawOffset    *int    `json:"rawOffset,omitempty"`
-	Status       *string `json:"status,omitempty"`
-	TimeZoneID   *string `json:"timeZoneId,omitempty"`
-	TimeZoneName *string `json:"timeZoneName,omitempty"`
-}
-
-func getTimezone(latitude, longitude float64) (*googleTimezone, error) {
-
-	// TODO: Send proper timestamp to get the dst... or...?
-	url := fmt.Sprintf("https://maps.googleapis.com/maps/api/timezone/json?location=%f,%f&timestamp=1414645501", latitude, longitude)
-
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New("Could not access schema " + resp.Status)
-	}
-
-	bodyBuff, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	var tz googleTimezone
-	err = json.Unmarshal(bodyBuff, &tz)
-	if err != nil {
-		return nil, err
-	}
-
-	if *tz.Status != "OK" {
-		return nil, fmt.Errorf("Failed to get timezone: %s", *tz.Status)
-	}
-
-	/*
-
-	   req := &geocode.Request{
-	     Region:   "us",
-	     Provider: geocode.GOOGLE,
-	     Location: &geocode.Point{-33.86, 151.20},
-	   }*/
-
-	return &tz, nil
-}
@@ -1,7 +1,9 @@
 package models
 
 import (
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -17,6 +19,8 @@ type ThingModel struct {
 	DeviceModel  *DeviceModel       `inject:""`
 	RoomModel    *RoomModel         `inject:""`
 	StateManager state.StateManager `inject:""`
+
+	deviceThings *deviceThingCache
 }
 
 var autoPromote = config.Bool(false, "homecloud.autopromote")
@@ -32,7 +36,8 @@ func toThing(obj interface{}) *model.Thing {
 func NewThingModel() *ThingModel {
 
 	thingModel := &ThingModel{
-		baseModel: newBaseModel("thing", model.Thing{}),
+		baseModel:    newBaseModel("thing", model.Thing{}),
+		deviceThings: &deviceThingCache{things: make(map[string]string)},
 	}
 
 	thingModel.baseModel.afterSave = func(obj interface{}, conn redis.Conn) error {
@@ -167,6 +172,8 @@ func (m *ThingModel) afterSave(thing *model.Thing, conn redis.Conn) error {
 			if err != nil {
 				return fmt.Errorf("Failed to update device relationship. error: %s", err)
 			}
+
+			m.deviceThings.set(*thing.DeviceID, thing.ID)
 		}
 
 		if err == nil {
@@ -209,8 +216,7 @@ func (m *ThingModel) Delete(r *DeleteRequest, conn redis.Conn) error {
 
 func (m *ThingModel) afterDelete(deletedThing *model.Thing, conn redis.Conn) error {
 
-	// TODO: announce deletion via MQTT
-	// self.bus.publish(Ninja.topics.thing.goodbye.thing(thing.id), {id: thing.id});
+	m.sayGoodbye(fmt.Sprintf("$thing/%s/event/goodbye", deletedThing.ID), map[string]string{"id": deletedThing.ID})
 
 	deviceID, err := m.GetDeviceIDForThing(deletedThing.ID, conn)
 
@@ -263,11 +269,16 @@ func (m *ThingModel) SetLocation(thingID string, roomID *string, conn redis.Conn
 	err = m.RoomModel.MoveThing(existing.Location, roomID, thingID, conn)
 
 	if err != nil {
+		from := "no room"
+		if existing.Location != nil {
+			from = *existing.Location
+		}
+
 		if roomID == nil {
-			return fmt.Errorf("Failed to remove thing %s from %s", thingID, existing.Location)
+			return fmt.Errorf("Failed to remove thing %s from %s: %s", thingID, from, err)
 		}
 
-		return fmt.Errorf("Failed to move thing %s from %s to %s", thingID, existing.Location, *roomID)
+		return fmt.Errorf("Failed to move thing %s from %s to %s: %s", thingID, from, *roomID, err)
 	}
 
 	existing.Location = roomID
@@ -392,6 +403,111 @@ func (m *ThingModel) Update(id string, thing *model.Thing, conn redis.Conn) erro
 	return nil
 }
 
+// DeviceHasThing is returned when replacing a device with one whose thing was promoted (i.e. set
+// up by the user), rather than automatically created
+var DeviceHasThing = errors.New("The device already has a promoted thing")
+
+type ReplaceDeviceRequest struct {
+	ThingID         string `json:"thingID"`
+	DeviceID        string `json:"deviceID"`
+	DeleteOldDevice bool   `json:"deleteOldDevice"`
+}
+
+// ReplaceDevice moves a thing onto a new physical device (i.e. when a bulb dies and is replaced).
+// The thing keeps its name, room etc., the thing automatically created for the new device is
+// removed, and the old device is optionally deleted. If the new device's thing has been promoted
+// it is left alone, and DeviceHasThing returned.
+func (m *ThingModel) ReplaceDevice(r *ReplaceDeviceRequest, conn redis.Conn) (*model.Thing, error) {
+	m.syncing.Wait()
+	defer syncFS()
+
+	thing := &model.Thing{}
+	if err := m.fetch(r.ThingID, thing, true, conn); err != nil {
+		return nil, err
+	}
+
+	exists, err := m.DeviceModel.Exists(r.DeviceID, conn)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, RecordNotFound
+	}
+
+	oldDeviceID := thing.DeviceID
+	if oldDeviceID != nil && *oldDeviceID == r.DeviceID {
+		// Nothing to do
+		return m.Fetch(thing.ID, conn)
+	}
+
+	orphanID, err := m.GetThingIDForDevice(r.DeviceID, conn)
+	if err != nil && err != RecordNotFound {
+		return nil, err
+	}
+
+	var orphan *model.Thing
+	if orphanID != nil && *orphanID != thing.ID {
+		existing := &model.Thing{}
+		err := m.fetch(*orphanID, existing, true, conn)
+		if err != nil && err != RecordNotFound {
+			return nil, err
+		}
+		if err == nil {
+			if existing.Promoted {
+				return nil, DeviceHasThing
+			}
+			orphan = existing
+		}
+	}
+
+	m.log.Infof("Replacing device %v with %s on thing %s", oldDeviceID, r.DeviceID, thing.ID)
+
+	conn.Send("MULTI")
+	if oldDeviceID != nil {
+		conn.Send("HDEL", "device-thing", *oldDeviceID)
+	}
+	conn.Send("HSET", "device-thing", r.DeviceID, thing.ID)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return nil, fmt.Errorf("Failed to update device relationship. error: %s", err)
+	}
+
+	if oldDeviceID != nil {
+		m.deviceThings.remove(*oldDeviceID)
+	}
+	m.deviceThings.set(r.DeviceID, thing.ID)
+
+	if orphanID != nil && *orphanID != thing.ID {
+		if orphan != nil && orphan.Location != nil {
+			if err := m.RoomModel.MoveThing(orphan.Location, nil, orphan.ID, conn); err != nil {
+				m.log.Warningf("Failed to remove replaced thing %s from room %s error:%s", orphan.ID, *orphan.Location, err)
+			}
+		}
+
+		// The relationship has already moved, so this won't recreate a thing for the device.
+		if err := m.delete(*orphanID, conn); err != nil && err != RecordNotFound {
+			return nil, fmt.Errorf("Failed to delete thing %s previously attached to device %s. error: %s", *orphanID, r.DeviceID, err)
+		}
+	}
+
+	if r.DeleteOldDevice && oldDeviceID != nil {
+		if err := m.DeviceModel.Delete(*oldDeviceID, conn); err != nil && err != RecordNotFound {
+			m.log.Warningf("Failed to delete replaced device %s error:%s", *oldDeviceID, err)
+		}
+	}
+
+	if m.sendEvent != nil {
+		m.sendEvent("updated", thing.ID)
+	}
+
+	// The relationship isn't stored on the thing itself, so the change needs to be recorded
+	// for it to sync.
+	if err := m.recordChange(thing.ID, "update", "local", conn); err != nil {
+		return nil, fmt.Errorf("Failed to mark thing updated. error: %s", err)
+	}
+
+	return m.Fetch(thing.ID, conn)
+}
+
 // -- Device<->Thing one-to-one relationship --
 
 func (m *ThingModel) deleteRelationshipWithDevice(deviceID string, conn redis.Conn) error {
@@ -400,11 +516,26 @@ func (m *ThingModel) deleteRelationshipWithDevice(deviceID string, conn redis.Co
 
 	_, err := conn.Do("HDEL", "device-thing", deviceID)
 
+	if err == nil {
+		m.deviceThings.remove(deviceID)
+	}
+
 	return err
 }
 
+// GetThingIDForDevice returns the id of the thing attached to a device. Relationships
+// are cached in memory once seen, as this is called for every relayed device message.
 func (m *ThingModel) GetThingIDForDevice(deviceID string, conn redis.Conn) (*string, error) {
 
+	thingID, ok, version := m.deviceThings.get(deviceID)
+	if ok {
+		if thingID == "" {
+			// Known to have no thing
+			return nil, RecordNotFound
+		}
+		return &thingID, nil
+	}
+
 	item, err := conn.Do("HGET", "device-thing", deviceID)
 
 	if err != nil {
@@ -412,10 +543,16 @@ func (m *ThingModel) GetThingIDForDevice(deviceID string, conn redis.Conn) (*str
 	}
 
 	if item == nil {
+		// Until a thing is saved with the device, so events from it aren't looked up every time
+		m.deviceThings.setMissing(deviceID, version)
 		return nil, RecordNotFound
 	}
 
-	thingID, err := redis.String(item, err)
+	thingID, err = redis.String(item, err)
+
+	if err == nil {
+		m.deviceThings.set(deviceID, thingID)
+	}
 
 	return &thingID, err
 }
@@ -440,3 +577,42 @@ func (m *ThingModel) GetDeviceIDForThing(thingID string, conn redis.Conn) (*stri
 
 	return nil, RecordNotFound
 }
+
+// deviceThingCache mirrors the "device-thing" hash, with "" for devices known not to be in it.
+// It is only written to by the ThingModel, alongside the matching change in redis.
+type deviceThingCache struct {
+	sync.RWMutex
+	things  map[string]string
+	version int // Changes with every write, so a miss read before one isn't cached after it
+}
+
+func (c *deviceThingCache) get(deviceID string) (string, bool, int) {
+	c.RLock()
+	defer c.RUnlock()
+	thingID, ok := c.things[deviceID]
+	return thingID, ok, c.version
+}
+
+func (c *deviceThingCache) set(deviceID, thingID string) {
+	c.Lock()
+	defer c.Unlock()
+	c.things[deviceID] = thingID
+	c.version++
+}
+
+// setMissing records that a device has no thing, unless the cache has been written to since
+// version
+func (c *deviceThingCache) setMissing(deviceID string, version int) {
+	c.Lock()
+	defer c.Unlock()
+	if c.version == version {
+		c.things[deviceID] = ""
+	}
+}
+
+func (c *deviceThingCache) remove(deviceID string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.things, deviceID)
+	c.version++
+}
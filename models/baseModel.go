@@ -37,6 +37,7 @@ func newBaseModel(idType string, obj interface{}) baseModel {
 
 	return baseModel{
 		syncing:     &sync.WaitGroup{},
+		syncLock:    &sync.Mutex{},
 		idType:      idType,
 		objType:     objType,
 		log:         logger.GetLogger(objType.Name() + "Model"),
@@ -55,14 +56,22 @@ type baseModel struct {
 
 	SyncConn *SyncConnection `inject:""`
 
-	syncing     *sync.WaitGroup
+	ConflictLog *ConflictLog `inject:""`
+	SyncMonitor *SyncMonitor `inject:""`
+
+	SyncExclusions *SyncExclusions `inject:""`
+
+	syncing     *sync.WaitGroup // Readers wait on this while a sync is running
+	syncLock    *sync.Mutex     // Only one sync of the model at a time, full or changes
 	idType      string
 	objType     reflect.Type
 	log         *logger.Logger
 	afterSave   func(obj interface{}, conn redis.Conn) error
 	afterDelete func(obj interface{}, conn redis.Conn) error
 	onFetch     func(obj interface{}, syncing bool, conn redis.Conn) error
+	unchanged   func(existing interface{}, obj interface{}) bool
 	sendEvent   func(event string, payload interface{}) error
+	onChange    func(id string)
 
 	entityLocks map[string]*sync.Mutex
 }
@@ -113,6 +122,12 @@ func (m *baseModel) fetchIds(conn redis.Conn) ([]string, error) {
 }
 
 func (m *baseModel) save(id string, obj interface{}, conn redis.Conn) (bool, error) {
+	return m.saveFrom(id, obj, "local", conn)
+}
+
+// saveFrom saves an object that came from source, "local" or "cloud". Only local changes are
+// reported to the change handler, as the cloud already has the others.
+func (m *baseModel) saveFrom(id string, obj interface{}, source string, conn redis.Conn) (bool, error) {
 
 	m.log.Debugf("Saving %s %s", m.idType, id)
 
@@ -128,8 +143,13 @@ func (m *baseModel) save(id string, obj interface{}, conn redis.Conn) (bool, err
 
 	brandNew := err == RecordNotFound
 
+	unchanged := m.isUnchanged
+	if m.unchanged != nil {
+		unchanged = m.unchanged
+	}
+
 	if err == nil {
-		if m.isUnchanged(existing.Interface(), obj) {
+		if unchanged(existing.Interface(), obj) {
 			m.log.Debugf("%s %s was unchanged.", m.idType, id)
 
 			return false, nil
@@ -169,10 +189,20 @@ func (m *baseModel) save(id string, obj interface{}, conn redis.Conn) (bool, err
 		}
 	}
 
-	return true, m.markUpdated(id, time.Now(), conn)
+	if brandNew {
+		err = m.recordChange(id, "create", source, conn)
+	} else {
+		err = m.recordChange(id, "update", source, conn)
+	}
+
+	return true, err
 }
 
 func (m *baseModel) delete(id string, conn redis.Conn) error {
+	return m.deleteFrom(id, "local", conn)
+}
+
+func (m *baseModel) deleteFrom(id string, source string, conn redis.Conn) error {
 
 	m.log.Debugf("Deleting %s %s", m.idType, id)
 
@@ -213,7 +243,29 @@ func (m *baseModel) delete(id string, conn redis.Conn) error {
 		m.sendEvent("deleted", id)
 	}
 
-	return m.markUpdated(id, time.Now(), conn)
+	return m.recordChange(id, "delete", source, conn)
+}
+
+// recordChange journals a change to an object, marks it as updated so it is synced, and reports
+// it to the change handler if it was made locally. Changes that don't go through save or delete
+// (i.e. to relationships stored outside the object) need to call it themselves.
+func (m *baseModel) recordChange(id string, op string, source string, conn redis.Conn) error {
+	now := time.Now()
+
+	m.journal(id, op, source, now, conn)
+
+	err := m.markUpdated(id, now, conn)
+	if source == "local" {
+		m.changed(id)
+	}
+
+	return err
+}
+
+func (m *baseModel) changed(id string) {
+	if m.onChange != nil {
+		m.onChange(id)
+	}
 }
 
 func (m *baseModel) markUpdated(id string, t time.Time, conn redis.Conn) error {
@@ -284,8 +336,11 @@ type SyncReply struct {
 	PushedObjects    SyncDataSet              `json:"pushedObjects"`
 }
 
+// Sync reconciles every object in this model with the cloud
 func (m *baseModel) Sync(timeout time.Duration, conn redis.Conn) error {
-	m.syncing.Wait()
+	m.syncLock.Lock()
+	defer m.syncLock.Unlock()
+
 	m.syncing.Add(1)
 	defer m.syncing.Done()
 
@@ -294,65 +349,215 @@ func (m *baseModel) Sync(timeout time.Duration, conn redis.Conn) error {
 		return nil
 	}
 
-	m.log.Infof("sync: Syncing %ss. Save data from cloud?:%s", m.idType, enableSyncFromCloud)
+	m.log.Infof("sync: Syncing %ss. Save data from cloud?:%t", m.idType, enableSyncFromCloud)
 
-	var diffList SyncDifferenceList
+	m.SyncMonitor.started(m.idType, conn)
 
-	manifest, err := m.getSyncManifest(conn)
-	if err != nil {
-		return err
+	var pushed, pulled int
+
+	// Everything journalled so far is in the manifest, and unsynced changes are sent as journalled
+	deltas, head, err := m.journalDeltas(conn)
+
+	var manifest *SyncManifest
+	if err == nil {
+		manifest, err = m.getSyncManifest(true, conn)
+	}
+	if err == nil {
+		pushed, pulled, err = m.sync(manifest, deltas, true, timeout, conn)
+	}
+	if err == nil {
+		err = m.markSynced(conn)
+	}
+	if err == nil {
+		err = m.acknowledgeJournal(head, conn)
 	}
 
-	m.log.Debugf("sync: Sending %d %s local update times", len(*manifest), m.idType)
+	m.SyncMonitor.finished(m.idType, true, pushed, pulled, err, conn)
 
-	calcClient := m.SyncConn.Conn.GetServiceClient("$ninja/services/rpc/modelstore/calculate_sync_items")
-	err = calcClient.Call("modelstore.calculate_sync_items", []interface{}{m.idType, manifest}, &diffList, timeout)
+	return err
+}
 
-	if err != nil {
-		return fmt.Errorf("Failed calling calculate_sync_items for model %s error:%s", m.idType, err)
+// sync sends the manifest to the cloud and exchanges whatever is out of date. If it isn't the full
+// manifest, anything the cloud has that isn't in it is left alone. Objects with a change in deltas
+// are pushed (or deleted) as the journal recorded them, rather than as they are now.
+//
+// Both the manifest and the objects are sent in chunks of homecloud.sync.chunkSize, each with its
+// own timeout. Progress through a full sync is saved after every chunk, so if it fails part way
+// the next one carries on from there. It returns the number of objects pushed and pulled.
+func (m *baseModel) sync(manifest *SyncManifest, deltas map[string]*JournalEntry, full bool, timeout time.Duration, conn redis.Conn) (int, int, error) {
+
+	var plan *syncPlan
+	if full {
+		plan = m.loadSyncPlan(conn)
 	}
 
-	m.log.Infof("sync: Cloud requires %d %s(s), Node requires %d %s(s)", len(diffList.CloudRequires), m.idType, len(diffList.NodeRequires), m.idType)
+	if plan == nil {
+		plan = newSyncPlan(*manifest, deltas, full)
+	} else {
+		if plan.refresh(*manifest, deltas) && plan.CalculateDone {
+			// Transfers are safe to repeat, so start them again rather than send stale objects
+			m.log.Infof("sync: %s(s) changed since the %s sync started, planning its transfers again", m.idType, m.idType)
+			plan.planTransfers(deleteUnknownFromCloud && plan.Full)
+		}
 
-	if len(diffList.CloudRequires)+len(diffList.NodeRequires) == 0 {
-		// Nothing to do, we're in sync.
-		return nil
+		m.log.Infof("sync: Resuming %s sync started at %s (%d/%d manifest ids sent, %d/%d chunks done)", m.idType, plan.Started, plan.Calculated, len(plan.Manifest), plan.ChunksDone, plan.chunks())
 	}
 
-	requestIds := make([]string, 0)
-	for id := range diffList.NodeRequires {
-		requestIds = append(requestIds, id)
+	if !plan.CalculateDone {
+		if err := m.calculateSyncItems(plan, timeout, conn); err != nil {
+			return 0, 0, err
+		}
 	}
 
-	requestedData := SyncDataSet{}
+	m.log.Infof("sync: Cloud requires %d %s(s), Node requires %d %s(s)", len(plan.CloudRequires), m.idType, len(plan.NodeRequires), m.idType)
 
-	for id := range diffList.CloudRequires {
-		obj := reflect.New(m.objType).Interface()
+	pushed, pulled := 0, 0
 
-		err = m.fetch(id, obj, true, conn)
+	for plan.ChunksDone < plan.chunks() {
+		m.SyncMonitor.progress(m.idType, "transfer", plan.ChunksDone, plan.chunks(), conn)
 
-		if err != nil && err != RecordNotFound {
-			return fmt.Errorf("Failed retrieving requested %s id:%s error:%s", m.idType, id, err)
+		p, q, err := m.transferChunk(plan.chunk(plan.ChunksDone), timeout, conn)
+		if err != nil {
+			return pushed, pulled, err
 		}
 
-		if err == RecordNotFound {
-			obj = nil
+		pushed, pulled = pushed+p, pulled+q
+		plan.ChunksDone++
+
+		if full {
+			m.saveSyncPlan(plan, conn)
 		}
+	}
+
+	if !enableSyncFromCloud && len(plan.NodeRequires) > 0 {
+		m.log.Warningf("Ignoring sync data from cloud.")
+	}
+
+	if full {
+		m.clearSyncPlan(conn)
+	}
+
+	return pushed, pulled, nil
+}
 
-		lastUpdated, err := m.getLastUpdated(id, conn)
+// calculateSyncItems sends the manifest to the cloud a chunk at a time, and works out what needs
+// to be pushed and pulled
+func (m *baseModel) calculateSyncItems(plan *syncPlan, timeout time.Duration, conn redis.Conn) error {
+
+	ids := plan.manifestIds()
+
+	calcClient := m.SyncConn.Conn.GetServiceClient("$ninja/services/rpc/modelstore/calculate_sync_items")
+
+	for {
+		end := plan.Calculated + chunkSize()
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		m.SyncMonitor.progress(m.idType, "manifest", plan.Calculated, len(ids), conn)
+
+		chunk := make(SyncManifest)
+		for _, id := range ids[plan.Calculated:end] {
+			chunk[id] = plan.Manifest[id]
+		}
+
+		m.log.Debugf("sync: Sending %d of %d %s local update times", len(chunk), len(ids), m.idType)
+
+		var diffList SyncDifferenceList
+
+		err := calcClient.Call("modelstore.calculate_sync_items", []interface{}{m.idType, chunk}, &diffList, timeout)
 		if err != nil {
-			return fmt.Errorf("Failed retrieving last updated time for requested %s id:%s error:%s", m.idType, id, err)
+			return fmt.Errorf("Failed calling calculate_sync_items for model %s error:%s", m.idType, err)
 		}
 
-		requestedData[id] = SyncObject{obj, lastUpdated.UnixNano() / int64(time.Millisecond)}
+		for id, t := range diffList.CloudRequires {
+			plan.CloudRequires[id] = t
+		}
+
+		for id, t := range diffList.NodeRequires {
+			_, inChunk := chunk[id]
+			_, inManifest := plan.Manifest[id]
+
+			// The cloud thinks we need everything we didn't mention. If it's in another chunk, that
+			// chunk will say if we do. If it isn't in the manifest at all, we really don't have it,
+			// but a partial sync leaves those alone.
+			if inChunk || (!inManifest && plan.Full) {
+				plan.NodeRequires[id] = t
+			}
+		}
+
+		plan.Calculated = end
+
+		if plan.Calculated >= len(ids) {
+			break
+		}
+
+		if plan.Full {
+			m.saveSyncPlan(plan, conn)
+		}
+	}
+
+	diffList := &SyncDifferenceList{Model: m.idType, CloudRequires: plan.CloudRequires, NodeRequires: plan.NodeRequires}
+	m.dropExcluded(diffList, true, conn)
+
+	plan.CalculateDone = true
+	plan.planTransfers(deleteUnknownFromCloud && plan.Full)
+
+	if plan.Full {
+		m.saveSyncPlan(plan, conn)
 	}
 
-	if deleteUnknownFromCloud {
-		for id := range diffList.NodeRequires {
-			if _, ok := (*manifest)[id]; !ok { // We've never heard of this, so remove it
+	return nil
+}
+
+// transferChunk pushes and pulls a chunk of objects. It returns the number pushed and pulled.
+func (m *baseModel) transferChunk(transfers []syncTransfer, timeout time.Duration, conn redis.Conn) (int, int, error) {
+
+	requestIds := make([]string, 0)
+	requestedData := SyncDataSet{}
+
+	for _, transfer := range transfers {
+		id := transfer.ID
+
+		switch transfer.Op {
+		case "pull":
+			requestIds = append(requestIds, id)
+
+		case "delete":
+			if transfer.Time != 0 {
+				// Deleted locally, as the journal recorded
+				m.log.Infof("Removing deleted %s id:%s from cloud.", m.idType, id)
+				requestedData[id] = SyncObject{nil, transfer.Time}
+			} else {
+				// We've never heard of this, so remove it
 				m.log.Infof("Removing %s id:%s from cloud.", m.idType, id)
 				requestedData[id] = SyncObject{nil, time.Now().UnixNano() / int64(time.Millisecond)}
 			}
+
+		case "push":
+			if transfer.Data != nil {
+				requestedData[id] = SyncObject{transfer.Data, transfer.Time}
+				continue
+			}
+
+			obj := reflect.New(m.objType).Interface()
+
+			err := m.fetch(id, obj, true, conn)
+
+			if err != nil && err != RecordNotFound {
+				return 0, 0, fmt.Errorf("Failed retrieving requested %s id:%s error:%s", m.idType, id, err)
+			}
+
+			if err == RecordNotFound {
+				obj = nil
+			}
+
+			lastUpdated, err := m.getLastUpdated(id, conn)
+			if err != nil || lastUpdated == nil {
+				return 0, 0, fmt.Errorf("Failed retrieving last updated time for requested %s id:%s error:%v", m.idType, id, err)
+			}
+
+			requestedData[id] = SyncObject{obj, lastUpdated.UnixNano() / int64(time.Millisecond)}
 		}
 	}
 
@@ -360,58 +565,275 @@ func (m *baseModel) Sync(timeout time.Duration, conn redis.Conn) error {
 
 	var syncReply SyncReply
 
-	err = syncClient.Call("modelstore.do_sync_items", []interface{}{m.idType, requestedData, requestIds}, &syncReply, timeout)
+	err := syncClient.Call("modelstore.do_sync_items", []interface{}{m.idType, requestedData, requestIds}, &syncReply, timeout)
 
 	if err != nil {
-		return fmt.Errorf("Failed calling do_sync_items for model %s error:%s", m.idType, err)
+		return 0, 0, fmt.Errorf("Failed calling do_sync_items for model %s error:%s", m.idType, err)
 	}
 
 	defer syncFS()
 
+	// What we pushed is now the common version, for spotting conflicts next time
+	for id, pushed := range requestedData {
+		if data, err := json.Marshal(pushed.(SyncObject).Data); err != nil {
+			m.log.Warningf("Failed to marshal pushed %s id:%s error: %s", m.idType, id, err)
+		} else if err := m.setSyncBase(id, data, conn); err != nil {
+			m.log.Warningf("Failed to save sync base of pushed %s id:%s error: %s", m.idType, id, err)
+		}
+	}
+
+	pushed, pulled := len(requestedData), 0
+
 	if enableSyncFromCloud {
 
-		for id, requestedObj := range syncReply.RequestedObjects {
-			obj := reflect.New(m.objType).Interface()
+		pulled = len(syncReply.RequestedObjects)
 
-			err := json.Unmarshal(requestedObj.Data, obj)
+		// Objects we kept (or merged) after a conflict, that the cloud now needs
+		repush := SyncDataSet{}
+
+		for id, requestedObj := range syncReply.RequestedObjects {
+			push, err := m.applyRequested(id, requestedObj, conn)
 			if err != nil {
-				m.log.Warningf("Failed to unmarshal requested %s id:%s error: %s", m.idType, id, err)
-				m.delete(id, conn)
-			} else if string(requestedObj.Data) == "null" {
-				m.log.Infof("Requested %s id:%s has been remotely deleted", m.idType, id)
-				m.delete(id, conn)
-			} else {
+				return 0, 0, err
+			}
+			if push != nil {
+				repush[id] = *push
+			}
+		}
 
-				updated, err := m.save(id, obj, conn)
-				if err != nil {
-					return fmt.Errorf("Failed to save requested %s id:%s error: %s", m.idType, id, err)
-				}
-				if !updated {
-					m.log.Warningf("We requested an updated %s id:%s but it was the same as what we had.", m.idType, id)
-				}
+		if len(repush) > 0 {
+			m.log.Infof("sync: Pushing %d %s(s) resolved locally after conflicts", len(repush), m.idType)
 
+			err = syncClient.Call("modelstore.do_sync_items", []interface{}{m.idType, repush, []string{}}, &SyncReply{}, timeout)
+			if err != nil {
+				return 0, 0, fmt.Errorf("Failed calling do_sync_items for resolved %ss error:%s", m.idType, err)
 			}
 
-			err = m.markUpdated(id, time.Unix(0, requestedObj.LastModified*int64(time.Millisecond)), conn)
-			if err != nil {
-				m.log.Warningf("Failed to update last modified time of requested %s id:%s error: %s", m.idType, id, err)
+			pushed += len(repush)
+		}
+	}
+
+	return pushed, pulled, nil
+}
+
+func (m *baseModel) markSynced(conn redis.Conn) error {
+	ts, err := time.Now().MarshalText()
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("SET", m.idType+"s:synced", ts)
+	return err
+}
+
+// applyRequested saves (or deletes) an object requested from the cloud. If it was also changed
+// locally since we last synced it, the model's conflict policy decides which version is kept.
+// The returned object, if any, is the local or merged version that has to be pushed back to the cloud.
+func (m *baseModel) applyRequested(id string, requestedObj SyncRawObject, conn redis.Conn) (*SyncObject, error) {
+
+	obj := reflect.New(m.objType).Interface()
+
+	if err := json.Unmarshal(requestedObj.Data, obj); err != nil {
+		m.log.Warningf("Failed to unmarshal requested %s id:%s error: %s", m.idType, id, err)
+		m.deleteFrom(id, "cloud", conn)
+
+		if err := m.markUpdated(id, time.Unix(0, requestedObj.LastModified*int64(time.Millisecond)), conn); err != nil {
+			m.log.Warningf("Failed to update last modified time of requested %s id:%s error: %s", m.idType, id, err)
+		}
+		return nil, nil
+	}
+
+	d, err := m.decideRequested(id, requestedObj, obj, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.conflict != nil {
+		if err := m.ConflictLog.Record(d.conflict, conn); err != nil {
+			m.log.Warningf("Failed to log sync conflict on %s id:%s error: %s", m.idType, id, err)
+		}
+	}
+
+	resolution, local, localObj, merged, cloud := d.resolution, d.local, d.localObj, d.merged, d.cloud
+
+	now := time.Now()
+
+	switch resolution {
+	case "local":
+		m.log.Infof("Keeping local %s id:%s over the cloud's version", m.idType, id)
+
+		if err := m.markUpdated(id, now, conn); err != nil {
+			return nil, err
+		}
+		if err := m.setSyncBase(id, local, conn); err != nil {
+			m.log.Warningf("Failed to save sync base of %s id:%s error: %s", m.idType, id, err)
+		}
+
+		return &SyncObject{localObj, now.UnixNano() / int64(time.Millisecond)}, nil
+
+	case "merged":
+		obj = reflect.New(m.objType).Interface()
+		if err := json.Unmarshal(merged, obj); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal merged %s id:%s error: %s", m.idType, id, err)
+		}
+
+		if _, err := m.saveFrom(id, obj, "cloud", conn); err != nil {
+			return nil, fmt.Errorf("Failed to save merged %s id:%s error: %s", m.idType, id, err)
+		}
+		if err := m.markUpdated(id, now, conn); err != nil {
+			return nil, err
+		}
+		if data, err := json.Marshal(obj); err == nil {
+			if err := m.setSyncBase(id, data, conn); err != nil {
+				m.log.Warningf("Failed to save sync base of %s id:%s error: %s", m.idType, id, err)
 			}
 		}
+
+		return &SyncObject{obj, now.UnixNano() / int64(time.Millisecond)}, nil
+	}
+
+	if isNull(cloud) {
+		m.log.Infof("Requested %s id:%s has been remotely deleted", m.idType, id)
+		m.deleteFrom(id, "cloud", conn)
 	} else {
-		m.log.Warningf("Ignoring sync data from cloud.")
+
+		updated, err := m.saveFrom(id, obj, "cloud", conn)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to save requested %s id:%s error: %s", m.idType, id, err)
+		}
+		if !updated {
+			m.log.Warningf("We requested an updated %s id:%s but it was the same as what we had.", m.idType, id)
+		}
+
+	}
+
+	if err := m.markUpdated(id, time.Unix(0, requestedObj.LastModified*int64(time.Millisecond)), conn); err != nil {
+		m.log.Warningf("Failed to update last modified time of requested %s id:%s error: %s", m.idType, id, err)
 	}
 
+	if err := m.setSyncBase(id, cloud, conn); err != nil {
+		m.log.Warningf("Failed to save sync base of %s id:%s error: %s", m.idType, id, err)
+	}
+
+	return nil, nil
+}
+
+// syncDecision is what should happen to an object requested from the cloud
+type syncDecision struct {
+	resolution string // "cloud", "local" or "merged"
+	local      json.RawMessage
+	localObj   interface{}
+	cloud      json.RawMessage
+	merged     json.RawMessage
+	conflict   *SyncConflict
+}
+
+// decideRequested works out, without changing anything, whether to take the cloud's version of an
+// object, keep ours, or merge them. obj is the cloud's version, already unmarshalled.
+func (m *baseModel) decideRequested(id string, requestedObj SyncRawObject, obj interface{}, conn redis.Conn) (*syncDecision, error) {
+
+	// Re-marshal so the cloud's version can be compared with ours
+	cloud := json.RawMessage("null")
+	if !isNull(requestedObj.Data) {
+		cloud, _ = json.Marshal(obj)
+	}
+
+	localObj := reflect.New(m.objType).Interface()
+	local := json.RawMessage("null")
+
+	err := m.fetch(id, localObj, true, conn)
+	if err == RecordNotFound {
+		localObj = nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed retrieving local %s id:%s error:%s", m.idType, id, err)
+	} else if local, err = json.Marshal(localObj); err != nil {
+		return nil, err
+	}
+
+	base, err := m.getSyncBase(id, conn)
 	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving sync base for %s id:%s error:%s", m.idType, id, err)
+	}
 
-		ts, err := time.Now().MarshalText()
-		if err != nil {
-			return err
+	var localModified int64
+	if lastUpdated, _ := m.getLastUpdated(id, conn); lastUpdated != nil {
+		localModified = lastUpdated.UnixNano() / int64(time.Millisecond)
+	}
+
+	localChanged, cloudChanged := !isNull(local), true
+	if base != nil {
+		localChanged = string(local) != string(*base)
+		cloudChanged = string(cloud) != string(*base)
+	}
+
+	d := &syncDecision{resolution: "cloud", local: local, localObj: localObj, cloud: cloud}
+
+	if localChanged && string(local) != string(cloud) {
+		if !cloudChanged {
+			// Only we changed it, the cloud just doesn't know yet
+			d.resolution = "local"
+		} else {
+			conflict := &SyncConflict{
+				Model:         m.idType,
+				ObjectID:      id,
+				Local:         local,
+				Cloud:         cloud,
+				Base:          base,
+				LocalModified: localModified,
+				CloudModified: requestedObj.LastModified,
+				Time:          time.Now(),
+			}
+
+			var policy ConflictPolicy
+			conflict.Policy, policy = getConflictPolicy(m.idType)
+
+			d.resolution, d.merged, err = policy.Resolve(conflict)
+			if err != nil {
+				m.log.Warningf("Conflict policy %s failed on %s id:%s, using last-writer-wins. error: %s", conflict.Policy, m.idType, id, err)
+				d.resolution, d.merged, _ = lastWriterWins(conflict)
+			}
+
+			conflict.Resolution = d.resolution
+			switch d.resolution {
+			case "local":
+				conflict.Result = local
+			case "merged":
+				conflict.Result = d.merged
+			default:
+				conflict.Result = cloud
+			}
+
+			d.conflict = conflict
 		}
+	}
 
-		_, err = conn.Do("SET", m.idType+"s:synced", ts)
+	return d, nil
+}
+
+// getSyncBase returns the JSON of the object as it was when it was last synced, or nil if it never has been
+func (m *baseModel) getSyncBase(id string, conn redis.Conn) (*json.RawMessage, error) {
+	item, err := conn.Do("HGET", m.idType+"s:base", id)
 
+	if err != nil || item == nil {
+		return nil, err
 	}
 
+	data, err := redis.Bytes(item, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	base := json.RawMessage(data)
+	return &base, nil
+}
+
+func (m *baseModel) setSyncBase(id string, data json.RawMessage, conn redis.Conn) error {
+	var err error
+	if isNull(data) {
+		_, err = conn.Do("HDEL", m.idType+"s:base", id)
+	} else {
+		_, err = conn.Do("HSET", m.idType+"s:base", id, []byte(data))
+	}
 	return err
 }
 
@@ -450,13 +872,19 @@ func (m *baseModel) ClearCloud() error {
 	return nil
 }
 
-func (m *baseModel) getSyncManifest(conn redis.Conn) (*SyncManifest, error) {
+// getSyncManifest returns the last updated time of every object that isn't excluded. When syncing,
+// withhold is set so the exclusion of each object is remembered (see isExcluded).
+func (m *baseModel) getSyncManifest(withhold bool, conn redis.Conn) (*SyncManifest, error) {
 
 	var manifest SyncManifest = make(map[string]int64)
 
 	item, err := redis.Strings(conn.Do("HGETALL", m.idType+"s:updated"))
 
 	for i := 0; i < len(item); i += 2 {
+		if m.isExcluded(item[i], withhold, conn) {
+			continue
+		}
+
 		t := time.Time{}
 		err := t.UnmarshalText([]byte(item[i+1]))
 		if err != nil {
@@ -472,6 +900,55 @@ func (m *baseModel) getSyncManifest(conn redis.Conn) (*SyncManifest, error) {
 	return &manifest, nil
 }
 
+// isExcluded says whether an object is kept out of the cloud. If we can't tell, it is,
+// as it's better to sync it later than to send something that should have stayed local.
+// If withhold is set, whether it was excluded is remembered for when it's deleted; only syncs
+// should set it, as previews don't write anything.
+func (m *baseModel) isExcluded(id string, withhold bool, conn redis.Conn) bool {
+	check := m.SyncExclusions.IsExcluded
+	if withhold {
+		check = m.SyncExclusions.withhold
+	}
+
+	excluded, err := check(m.idType, id, conn)
+	if err != nil {
+		m.log.Warningf("Failed to check sync exclusion of %s id:%s, not syncing it. error: %s", m.idType, id, err)
+		return true
+	}
+	return excluded
+}
+
+// dropExcluded removes excluded objects from what the cloud wants to exchange, even if it
+// already has them from before they were excluded
+func (m *baseModel) dropExcluded(diffList *SyncDifferenceList, withhold bool, conn redis.Conn) {
+	for _, ids := range []SyncManifest{diffList.CloudRequires, diffList.NodeRequires} {
+		for id := range ids {
+			if m.isExcluded(id, withhold, conn) {
+				m.log.Debugf("sync: Ignoring excluded %s id:%s", m.idType, id)
+				delete(ids, id)
+			}
+		}
+	}
+}
+
+// sayGoodbye announces the removal of an entity on its own topic, for anyone
+// (apps, the location service) holding on to it.
+func (m *baseModel) sayGoodbye(topic string, payload interface{}) {
+	if err := m.Conn.SendNotification(topic, payload); err != nil {
+		m.log.Warningf("Failed to announce removal on %s error:%s", topic, err)
+	}
+}
+
+// SetChangeHandler is called with the id of every object saved or deleted, other than by syncing
+func (m *baseModel) SetChangeHandler(handler func(id string)) {
+	m.onChange = handler
+}
+
+// SetPendingCounter reports how many changes are waiting to be synced, for the sync status
+func (m *baseModel) SetPendingCounter(counter func() int) {
+	m.SyncMonitor.setPendingCounter(m.idType, counter)
+}
+
 func (m *baseModel) SetEventHandler(handler func(event string, payload interface{}) error) {
 	m.log.Infof("Got handler! %+v", handler)
 	// FIXME: this method should probably be renamed to SetEventSender.
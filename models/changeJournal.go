@@ -0,0 +1,389 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+	"github.com/ninjasphere/redigo/redis"
+)
+
+var journalRetain = config.Int(1000, "homecloud.sync.journal.retain")
+var journalEnabled = config.Bool(true, "homecloud.sync.enabled") && !config.NoCloud()
+
+// JournalEntry is a single change to an object. Data is the object as it was saved, in the form
+// it is sent to the cloud, and Hash is its SHA-1 (deletes have neither). Source is "local", or
+// "cloud" if it was saved from the cloud by a sync.
+type JournalEntry struct {
+	Seq          int64           `json:"seq"`
+	ID           string          `json:"id"`
+	Op           string          `json:"op"` // "create", "update" or "delete"
+	Time         time.Time       `json:"time"`
+	Hash         string          `json:"hash,omitempty"`
+	Data         json.RawMessage `json:"data,omitempty"`
+	Source       string          `json:"source"`
+	Acknowledged bool            `json:"acknowledged"`
+}
+
+// ChangeJournal is the changes made to a model, oldest first. Everything up to Acknowledged has
+// been synced with the cloud.
+type ChangeJournal struct {
+	Model        string          `json:"model"`
+	Head         int64           `json:"head"`
+	Acknowledged int64           `json:"acknowledged"`
+	Entries      []*JournalEntry `json:"entries"`
+}
+
+// journal appends a change to <model>s:journal. Each model's changes are numbered in order by
+// <model>s:journalSeq, and the latest change to each object is also kept in <model>s:journalLatest
+// so a sync doesn't have to read the whole journal. Once the cloud acknowledges them they are
+// moved to <model>s:journalSynced, so the journal itself only holds what is still to be synced.
+// Nothing is journalled while syncing is off, as nothing would ever acknowledge it.
+// A failure is only logged, as the change itself has already been made.
+func (m *baseModel) journal(id string, op string, source string, t time.Time, conn redis.Conn) {
+
+	if !journalEnabled {
+		return
+	}
+
+	entry := &JournalEntry{
+		ID:     id,
+		Op:     op,
+		Time:   t,
+		Source: source,
+	}
+
+	if op != "delete" {
+		// Journal it as it would be synced, i.e. without any secrets
+		synced := reflect.New(m.objType).Interface()
+		if err := m.fetch(id, synced, true, conn); err != nil {
+			m.log.Warningf("Failed to fetch %s id:%s for the change journal: %s", m.idType, id, err)
+			return
+		}
+
+		data, err := json.Marshal(synced)
+		if err != nil {
+			m.log.Warningf("Failed to marshal %s id:%s for the change journal: %s", m.idType, id, err)
+			return
+		}
+		entry.Data = data
+		entry.Hash = hashPayload(data)
+	}
+
+	seq, err := redis.Int64(conn.Do("INCR", m.idType+"s:journalSeq"))
+	if err != nil {
+		m.log.Warningf("Failed to number change to %s id:%s: %s", m.idType, id, err)
+		return
+	}
+	entry.Seq = seq
+
+	data, err := json.Marshal(entry)
+	if err == nil {
+		conn.Send("MULTI")
+		conn.Send("RPUSH", m.idType+"s:journal", data)
+		conn.Send("HSET", m.idType+"s:journalLatest", id, data)
+		_, err = conn.Do("EXEC")
+	}
+
+	if err != nil {
+		m.log.Warningf("Failed to journal change to %s id:%s: %s", m.idType, id, err)
+	}
+}
+
+func (m *baseModel) getJournalSeq(key string, conn redis.Conn) (int64, error) {
+	item, err := conn.Do("GET", m.idType+"s:"+key)
+	if err != nil || item == nil {
+		return 0, err
+	}
+	return redis.Int64(item, nil)
+}
+
+// fetchJournal returns up to limit (or all, if it's 0) journal entries after since
+func (m *baseModel) fetchJournal(since int64, limit int, conn redis.Conn) (*ChangeJournal, error) {
+
+	journal := &ChangeJournal{
+		Model:   m.idType,
+		Entries: []*JournalEntry{},
+	}
+
+	var err error
+
+	if journal.Head, err = m.getJournalSeq("journalSeq", conn); err != nil {
+		return nil, err
+	}
+	if journal.Acknowledged, err = m.getJournalSeq("journalAcked", conn); err != nil {
+		return nil, err
+	}
+
+	keys := []string{m.idType + "s:journal"}
+	if since < journal.Acknowledged {
+		keys = []string{m.idType + "s:journalSynced", m.idType + "s:journal"}
+	}
+
+	for _, key := range keys {
+		items, err := redis.Strings(conn.Do("LRANGE", key, 0, -1))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range items {
+			entry := &JournalEntry{}
+			if err := json.Unmarshal([]byte(item), entry); err != nil {
+				m.log.Warningf("Skipping unreadable %s journal entry: %s", m.idType, err)
+				continue
+			}
+
+			if entry.Seq <= since {
+				continue
+			}
+
+			entry.Acknowledged = entry.Seq <= journal.Acknowledged
+			journal.Entries = append(journal.Entries, entry)
+
+			if limit > 0 && len(journal.Entries) == limit {
+				return journal, nil
+			}
+		}
+	}
+
+	return journal, nil
+}
+
+// journalDeltas returns the latest change to each object since the journal was last acknowledged,
+// if it was made locally, and the journal's head, to acknowledge once they are synced
+func (m *baseModel) journalDeltas(conn redis.Conn) (map[string]*JournalEntry, int64, error) {
+
+	// The head is read first, so anything journalled after it is left for the next sync
+	head, err := m.getJournalSeq("journalSeq", conn)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	acked, err := m.getJournalSeq("journalAcked", conn)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	items, err := redis.Strings(conn.Do("HVALS", m.idType+"s:journalLatest"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	deltas := make(map[string]*JournalEntry)
+
+	for _, item := range items {
+		entry := &JournalEntry{}
+		if err := json.Unmarshal([]byte(item), entry); err != nil {
+			m.log.Warningf("Skipping unreadable %s journal entry: %s", m.idType, err)
+			continue
+		}
+
+		if entry.Seq <= acked || entry.Seq > head {
+			continue
+		}
+
+		if entry.Source != "local" {
+			// The cloud's version replaced ours, so it has nothing to catch up on
+			continue
+		}
+
+		deltas[entry.ID] = entry
+	}
+
+	return deltas, head, nil
+}
+
+// acknowledgeJournal records that the cloud has every change up to seq, and compacts the journal
+// by moving those changes to <model>s:journalSynced. Only the most recent
+// homecloud.sync.journal.retain of them are kept there, for auditing.
+func (m *baseModel) acknowledgeJournal(seq int64, conn redis.Conn) error {
+
+	acked, err := m.getJournalSeq("journalAcked", conn)
+	if err != nil {
+		return err
+	}
+
+	if seq > acked {
+		if _, err := conn.Do("SET", m.idType+"s:journalAcked", seq); err != nil {
+			return err
+		}
+		acked = seq
+	}
+
+	// New entries are only ever appended, and only a sync takes them off the front, so the
+	// acknowledged ones are at the start
+	moved := 0
+
+	for {
+		item, err := conn.Do("LINDEX", m.idType+"s:journal", 0)
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			break
+		}
+
+		data, err := redis.Bytes(item, nil)
+		if err != nil {
+			return err
+		}
+
+		entry := &JournalEntry{}
+		readable := json.Unmarshal(data, entry) == nil
+		if readable && entry.Seq > acked {
+			break
+		}
+
+		conn.Send("MULTI")
+		conn.Send("LPOP", m.idType+"s:journal")
+		conn.Send("RPUSH", m.idType+"s:journalSynced", data)
+		if _, err := conn.Do("EXEC"); err != nil {
+			return err
+		}
+
+		if readable {
+			if err := m.forgetLatest(entry, conn); err != nil {
+				return err
+			}
+		}
+
+		moved++
+	}
+
+	if moved == 0 {
+		return nil
+	}
+
+	m.log.Debugf("Compacted %s journal, %d entries acknowledged", m.idType, moved)
+
+	if journalRetain < 1 {
+		_, err = conn.Do("DEL", m.idType+"s:journalSynced")
+	} else {
+		_, err = conn.Do("LTRIM", m.idType+"s:journalSynced", -journalRetain, -1)
+	}
+
+	return err
+}
+
+// forgetLatest removes an acknowledged entry from <model>s:journalLatest, unless the object has
+// been changed again since. The key is watched, so a change journalled in between isn't lost.
+func (m *baseModel) forgetLatest(entry *JournalEntry, conn redis.Conn) error {
+	key := m.idType + "s:journalLatest"
+
+	for {
+		if _, err := conn.Do("WATCH", key); err != nil {
+			return err
+		}
+
+		item, err := conn.Do("HGET", key, entry.ID)
+		if err != nil || item == nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		data, err := redis.Bytes(item, nil)
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		latest := &JournalEntry{}
+		if err := json.Unmarshal(data, latest); err == nil && latest.Seq > entry.Seq {
+			_, err = conn.Do("UNWATCH")
+			return err
+		}
+
+		conn.Send("MULTI")
+		conn.Send("HDEL", key, entry.ID)
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+		if reply != nil {
+			return nil
+		}
+		// Something was journalled in the meantime, check again
+	}
+}
+
+// SyncJournal sends the cloud every change made locally since it last acknowledged the journal,
+// as the journal recorded it. That includes objects that were created and deleted again without
+// ever being synced.
+func (m *baseModel) SyncJournal(timeout time.Duration, conn redis.Conn) error {
+	m.syncLock.Lock()
+	defer m.syncLock.Unlock()
+
+	m.syncing.Add(1)
+	defer m.syncing.Done()
+
+	if config.NoCloud() {
+		return nil
+	}
+
+	deltas, head, err := m.journalDeltas(conn)
+	if err != nil {
+		return fmt.Errorf("Failed reading %s change journal: %s", m.idType, err)
+	}
+
+	var manifest SyncManifest = make(map[string]int64)
+
+	for id, delta := range deltas {
+		if m.isExcluded(id, true, conn) {
+			delete(deltas, id)
+			continue
+		}
+
+		if delta.Hash != "" {
+			// Changed and changed back, the cloud already has it
+			base, err := m.getSyncBase(id, conn)
+			if err != nil {
+				return fmt.Errorf("Failed retrieving sync base for %s id:%s error:%s", m.idType, id, err)
+			}
+			if base != nil && hashPayload(*base) == delta.Hash {
+				delete(deltas, id)
+				continue
+			}
+		}
+
+		manifest[id] = delta.Time.UnixNano() / int64(time.Millisecond)
+	}
+
+	if len(manifest) > 0 {
+		m.log.Infof("sync: Syncing %d changed %s(s)", len(manifest), m.idType)
+
+		m.SyncMonitor.started(m.idType, conn)
+
+		pushed, pulled, err := m.sync(&manifest, deltas, false, timeout, conn)
+		if err == nil {
+			err = m.markSynced(conn)
+		}
+
+		m.SyncMonitor.finished(m.idType, false, pushed, pulled, err, conn)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.acknowledgeJournal(head, conn)
+}
+
+func hashPayload(data []byte) string {
+	return fmt.Sprintf("%x", sha1.Sum(data))
+}
+
+// FetchJournal returns the change journal of a model, i.e. "thing", as an audit trail. Only
+// entries after since are returned, up to limit (or all of them, if it's 0).
+func (m *SyncMonitor) FetchJournal(model string, since int64, limit int, conn redis.Conn) (*ChangeJournal, error) {
+
+	for _, b := range m.synced() {
+		if b.idType == model {
+			return b.fetchJournal(since, limit, conn)
+		}
+	}
+
+	return nil, RecordNotFound
+}
@@ -17,6 +17,11 @@ func GetInjectables() []interface{} {
 	roomModel := NewRoomModel()
 	siteModel := NewSiteModel()
 	thingModel := NewThingModel()
+	floorModel := NewFloorModel()
+	quarantineModel := NewQuarantineModel()
+	conflictLog := NewConflictLog()
+	syncMonitor := NewSyncMonitor()
+	syncExclusions := NewSyncExclusions()
 
 	return []interface{}{
 		moduleModel, &moduleModel.baseModel,
@@ -25,6 +30,11 @@ func GetInjectables() []interface{} {
 		roomModel, &roomModel.baseModel,
 		siteModel, &siteModel.baseModel,
 		thingModel, &thingModel.baseModel,
+		floorModel, &floorModel.baseModel,
+		quarantineModel,
+		conflictLog,
+		syncMonitor,
+		syncExclusions,
 	}
 }
 
@@ -0,0 +1,231 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ninjasphere/go-ninja/config"
+	"github.com/ninjasphere/go-ninja/logger"
+	"github.com/ninjasphere/redigo/redis"
+)
+
+var defaultConflictPolicy = config.String("last-writer-wins", "homecloud.sync.conflicts.default")
+var conflictLogSize = config.Int(500, "homecloud.sync.conflicts.logSize")
+
+// SyncConflict is an object that was changed both locally and in the cloud since they were last in sync.
+// Local, Cloud and Base are the JSON of each version, "null" if it doesn't exist (i.e. was deleted).
+// Base is nil when we have never synced the object before.
+type SyncConflict struct {
+	ID            string           `json:"id"`
+	Model         string           `json:"model"`
+	ObjectID      string           `json:"objectId"`
+	Policy        string           `json:"policy"`
+	Resolution    string           `json:"resolution"` // "local", "cloud" or "merged"
+	Fields        []string         `json:"fields,omitempty"`
+	Local         json.RawMessage  `json:"local"`
+	Cloud         json.RawMessage  `json:"cloud"`
+	Base          *json.RawMessage `json:"base,omitempty"`
+	Result        json.RawMessage  `json:"result"`
+	LocalModified int64            `json:"localModified"`
+	CloudModified int64            `json:"cloudModified"`
+	Time          time.Time        `json:"time"`
+}
+
+// A ConflictPolicy decides which version of a conflicting object to keep. It returns the
+// resolution ("local", "cloud" or "merged"), and the merged object's JSON when merging.
+type ConflictPolicy interface {
+	Resolve(conflict *SyncConflict) (resolution string, merged json.RawMessage, err error)
+}
+
+// ConflictPolicyFunc lets an ordinary function be used as a ConflictPolicy
+type ConflictPolicyFunc func(conflict *SyncConflict) (string, json.RawMessage, error)
+
+func (f ConflictPolicyFunc) Resolve(conflict *SyncConflict) (string, json.RawMessage, error) {
+	return f(conflict)
+}
+
+var conflictPolicies = map[string]ConflictPolicy{
+	"last-writer-wins": ConflictPolicyFunc(lastWriterWins),
+	"local-wins": ConflictPolicyFunc(func(conflict *SyncConflict) (string, json.RawMessage, error) {
+		return "local", nil, nil
+	}),
+	"cloud-wins": ConflictPolicyFunc(func(conflict *SyncConflict) (string, json.RawMessage, error) {
+		return "cloud", nil, nil
+	}),
+	"merge": ConflictPolicyFunc(threeWayMerge),
+}
+
+// RegisterConflictPolicy makes a policy available to the models, by name.
+// Models pick their policy with homecloud.sync.conflicts.<model>, i.e. homecloud.sync.conflicts.thing
+func RegisterConflictPolicy(name string, policy ConflictPolicy) {
+	conflictPolicies[name] = policy
+}
+
+// modelConflictPolicies are the models that don't use homecloud.sync.conflicts.default unless told to
+var modelConflictPolicies = map[string]string{
+	// A module's config is changed both by its driver and by the user, so keep both changes
+	"module": "merge",
+}
+
+func getConflictPolicy(idType string) (string, ConflictPolicy) {
+	def := defaultConflictPolicy
+	if policy, ok := modelConflictPolicies[idType]; ok {
+		def = policy
+	}
+
+	name := config.String(def, "homecloud.sync.conflicts", idType)
+
+	if policy, ok := conflictPolicies[name]; ok {
+		return name, policy
+	}
+
+	logger.GetLogger("SyncConflicts").Warningf("Unknown conflict policy '%s' for %ss, using last-writer-wins", name, idType)
+	return "last-writer-wins", conflictPolicies["last-writer-wins"]
+}
+
+// lastWriterWins keeps whichever version was modified most recently. The cloud wins a tie.
+func lastWriterWins(conflict *SyncConflict) (string, json.RawMessage, error) {
+	if conflict.LocalModified > conflict.CloudModified {
+		return "local", nil, nil
+	}
+	return "cloud", nil, nil
+}
+
+// threeWayMerge takes each field from whichever side changed it since the base version.
+// Fields changed differently on both sides are decided by last-writer-wins, and listed in the conflict.
+// Without a base version, or if either side was deleted, the whole object is decided by last-writer-wins.
+func threeWayMerge(conflict *SyncConflict) (string, json.RawMessage, error) {
+
+	if conflict.Base == nil || isNull(conflict.Local) || isNull(conflict.Cloud) || isNull(*conflict.Base) {
+		return lastWriterWins(conflict)
+	}
+
+	var base, local, cloud map[string]json.RawMessage
+
+	for _, x := range []struct {
+		data json.RawMessage
+		into *map[string]json.RawMessage
+	}{{*conflict.Base, &base}, {conflict.Local, &local}, {conflict.Cloud, &cloud}} {
+		if err := json.Unmarshal(x.data, x.into); err != nil {
+			return "", nil, fmt.Errorf("Can't merge non-object %s id:%s error: %s", conflict.Model, conflict.ObjectID, err)
+		}
+	}
+
+	localWins, _, _ := lastWriterWins(conflict)
+
+	merged := make(map[string]json.RawMessage)
+
+	fields := make(map[string]bool)
+	for _, m := range []map[string]json.RawMessage{base, local, cloud} {
+		for field := range m {
+			fields[field] = true
+		}
+	}
+
+	for field := range fields {
+		b, l, c := fieldValue(base, field), fieldValue(local, field), fieldValue(cloud, field)
+
+		switch {
+		case l == c, c == b:
+			merged[field] = json.RawMessage(l)
+		case l == b:
+			merged[field] = json.RawMessage(c)
+		default:
+			conflict.Fields = append(conflict.Fields, field)
+			if localWins == "local" {
+				merged[field] = json.RawMessage(l)
+			} else {
+				merged[field] = json.RawMessage(c)
+			}
+		}
+	}
+
+	data, err := json.Marshal(merged)
+	return "merged", data, err
+}
+
+func fieldValue(obj map[string]json.RawMessage, field string) string {
+	if value, ok := obj[field]; ok {
+		return string(value)
+	}
+	return "null"
+}
+
+func isNull(data json.RawMessage) bool {
+	return data == nil || string(data) == "null"
+}
+
+// ConflictLog keeps the most recent sync conflicts, and how they were resolved
+type ConflictLog struct {
+	log *logger.Logger
+}
+
+func NewConflictLog() *ConflictLog {
+	return &ConflictLog{
+		log: logger.GetLogger("ConflictLog"),
+	}
+}
+
+func (l *ConflictLog) Record(conflict *SyncConflict, conn redis.Conn) error {
+
+	if conflict.ID == "" {
+		if uuid, err := uuid.NewRandom(); err != nil {
+			return err
+		} else {
+			conflict.ID = uuid.String()
+		}
+	}
+
+	l.log.Infof("Sync conflict on %s id:%s resolved as %s by %s", conflict.Model, conflict.ObjectID, conflict.Resolution, conflict.Policy)
+
+	data, err := json.Marshal(conflict)
+	if err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("LPUSH", "sync:conflicts", data)
+	conn.Send("LTRIM", "sync:conflicts", 0, conflictLogSize-1)
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// FetchAll returns the logged conflicts, newest first. If model is set, only conflicts for that model
+// are returned. A limit of 0 returns them all.
+func (l *ConflictLog) FetchAll(model string, limit int, conn redis.Conn) ([]*SyncConflict, error) {
+
+	items, err := redis.Strings(conn.Do("LRANGE", "sync:conflicts", 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts := []*SyncConflict{}
+
+	for _, item := range items {
+		conflict := &SyncConflict{}
+		if err := json.Unmarshal([]byte(item), conflict); err != nil {
+			l.log.Warningf("Failed to unmarshal logged conflict: %s", err)
+			continue
+		}
+
+		if model != "" && conflict.Model != model {
+			continue
+		}
+
+		conflicts = append(conflicts, conflict)
+
+		if limit > 0 && len(conflicts) == limit {
+			break
+		}
+	}
+
+	return conflicts, nil
+}
+
+func (l *ConflictLog) Clear(conn redis.Conn) error {
+	_, err := conn.Do("DEL", "sync:conflicts")
+	return err
+}
@@ -0,0 +1,233 @@
+package models
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/ninjasphere/go-ninja/logger"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/redigo/redis"
+)
+
+var UnknownExclusionModel = errors.New("Only things, devices and rooms can be excluded from sync")
+
+// SyncExclusionList is everything that is kept out of the cloud. Things of the listed types are
+// excluded too, and a thing's device and channels are excluded along with it.
+type SyncExclusionList struct {
+	Things  []string `json:"things"`
+	Devices []string `json:"devices"`
+	Rooms   []string `json:"rooms"`
+	Types   []string `json:"types"`
+}
+
+// SyncExclusions keeps chosen things, devices and rooms local-only. Excluded objects are left out of
+// the sync manifest, never pushed, and ignored if the cloud sends them.
+//
+// Objects found to be excluded are remembered in sync:withheld, so that once they are deleted (and
+// we can no longer tell what they belonged to) the deletion isn't pushed either.
+type SyncExclusions struct {
+	ThingModel   *ThingModel   `inject:""`
+	ChannelModel *ChannelModel `inject:""`
+	log          *logger.Logger
+}
+
+func NewSyncExclusions() *SyncExclusions {
+	return &SyncExclusions{
+		log: logger.GetLogger("SyncExclusions"),
+	}
+}
+
+func (e *SyncExclusions) FetchAll(conn redis.Conn) (*SyncExclusionList, error) {
+
+	flagged, err := redis.Strings(conn.Do("SMEMBERS", "sync:excluded"))
+	if err != nil {
+		return nil, err
+	}
+
+	list := &SyncExclusionList{
+		Things:  []string{},
+		Devices: []string{},
+		Rooms:   []string{},
+	}
+
+	for _, entry := range flagged {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch parts[0] {
+		case "thing":
+			list.Things = append(list.Things, parts[1])
+		case "device":
+			list.Devices = append(list.Devices, parts[1])
+		case "room":
+			list.Rooms = append(list.Rooms, parts[1])
+		}
+	}
+
+	list.Types, err = redis.Strings(conn.Do("SMEMBERS", "sync:excludedTypes"))
+
+	return list, err
+}
+
+// Exclude keeps a thing, device or room (and anything belonging to it) out of the cloud
+func (e *SyncExclusions) Exclude(modelType string, id string, conn redis.Conn) error {
+	if !excludable(modelType) {
+		return UnknownExclusionModel
+	}
+
+	e.log.Infof("Excluding %s %s from sync", modelType, id)
+
+	_, err := conn.Do("SADD", "sync:excluded", modelType+":"+id)
+	return err
+}
+
+// Include lets a previously excluded thing, device or room be synced again
+func (e *SyncExclusions) Include(modelType string, id string, conn redis.Conn) error {
+	if !excludable(modelType) {
+		return UnknownExclusionModel
+	}
+
+	e.log.Infof("Including %s %s in sync", modelType, id)
+
+	_, err := conn.Do("SREM", "sync:excluded", modelType+":"+id)
+	return err
+}
+
+// ExcludeType keeps every thing of a type (i.e. "camera") out of the cloud
+func (e *SyncExclusions) ExcludeType(thingType string, conn redis.Conn) error {
+	_, err := conn.Do("SADD", "sync:excludedTypes", thingType)
+	return err
+}
+
+func (e *SyncExclusions) IncludeType(thingType string, conn redis.Conn) error {
+	_, err := conn.Do("SREM", "sync:excludedTypes", thingType)
+	return err
+}
+
+// IsExcluded says whether an object of a model (i.e. "channel") is kept out of the cloud. It
+// doesn't change anything.
+func (e *SyncExclusions) IsExcluded(modelType string, id string, conn redis.Conn) (bool, error) {
+
+	excluded, err := e.checkExcluded(modelType, id, conn)
+
+	if err == RecordNotFound {
+		// It's gone, so it's excluded if it was when it still existed
+		return redis.Bool(conn.Do("SISMEMBER", "sync:withheld", modelType+":"+id))
+	}
+
+	return excluded, err
+}
+
+// withhold is IsExcluded for syncing. It also remembers whether the object was excluded, so once
+// it's deleted we still know whether to sync the deletion.
+func (e *SyncExclusions) withhold(modelType string, id string, conn redis.Conn) (bool, error) {
+
+	if !excludable(modelType) && modelType != "channel" {
+		// Nothing else can be excluded, so there's nothing to remember
+		return false, nil
+	}
+
+	excluded, err := e.checkExcluded(modelType, id, conn)
+
+	if err == RecordNotFound {
+		// It's gone, so it's excluded if it was when it still existed
+		return redis.Bool(conn.Do("SISMEMBER", "sync:withheld", modelType+":"+id))
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if excluded {
+		_, err = conn.Do("SADD", "sync:withheld", modelType+":"+id)
+	} else {
+		_, err = conn.Do("SREM", "sync:withheld", modelType+":"+id)
+	}
+
+	return excluded, err
+}
+
+// checkExcluded works out whether an existing object is excluded. It returns RecordNotFound if the
+// object doesn't exist.
+func (e *SyncExclusions) checkExcluded(modelType string, id string, conn redis.Conn) (bool, error) {
+
+	switch modelType {
+	case "thing":
+		return e.isThingExcluded(id, conn)
+	case "device":
+		return e.isDeviceExcluded(id, conn)
+	case "channel":
+		return e.isChannelExcluded(id, conn)
+	case "room":
+		return e.isFlagged("room", id, conn)
+	}
+
+	return false, nil
+}
+
+func (e *SyncExclusions) isFlagged(modelType string, id string, conn redis.Conn) (bool, error) {
+	return redis.Bool(conn.Do("SISMEMBER", "sync:excluded", modelType+":"+id))
+}
+
+func (e *SyncExclusions) isThingExcluded(id string, conn redis.Conn) (bool, error) {
+
+	thing := &model.Thing{}
+	if err := e.ThingModel.fetch(id, thing, true, conn); err != nil {
+		return false, err
+	}
+
+	if flagged, err := e.isFlagged("thing", id, conn); err != nil || flagged {
+		return flagged, err
+	}
+
+	return redis.Bool(conn.Do("SISMEMBER", "sync:excludedTypes", thing.Type))
+}
+
+func (e *SyncExclusions) isDeviceExcluded(id string, conn redis.Conn) (bool, error) {
+
+	exists, err := redis.Bool(conn.Do("EXISTS", "device:"+id))
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, RecordNotFound
+	}
+
+	if flagged, err := e.isFlagged("device", id, conn); err != nil || flagged {
+		return flagged, err
+	}
+
+	thingID, err := e.ThingModel.GetThingIDForDevice(id, conn)
+	if err == RecordNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	excluded, err := e.isThingExcluded(*thingID, conn)
+	if err == RecordNotFound {
+		return false, nil
+	}
+	return excluded, err
+}
+
+func (e *SyncExclusions) isChannelExcluded(id string, conn redis.Conn) (bool, error) {
+
+	channel := &model.Channel{}
+	if err := e.ChannelModel.fetch(id, channel, true, conn); err != nil {
+		return false, err
+	}
+
+	excluded, err := e.isDeviceExcluded(channel.DeviceID, conn)
+	if err == RecordNotFound {
+		return false, nil
+	}
+	return excluded, err
+}
+
+func excludable(modelType string) bool {
+	return modelType == "thing" || modelType == "device" || modelType == "room"
+}
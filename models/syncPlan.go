@@ -0,0 +1,232 @@
+package models
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+	"github.com/ninjasphere/redigo/redis"
+)
+
+var syncChunkSize = config.Int(100, "homecloud.sync.chunkSize")
+var syncResumeWindow = config.Duration(time.Hour, "homecloud.sync.resumeWindow")
+
+// syncPlan is how far a sync has got. Full syncs save it in <model>s:syncPlan after each chunk, so
+// one that fails part way can be resumed (within homecloud.sync.resumeWindow) instead of starting
+// again from scratch.
+type syncPlan struct {
+	Full    bool      `json:"full"`
+	Started time.Time `json:"started"`
+
+	// The manifest, and how many of its (sorted) ids have been sent to the cloud so far
+	Manifest      SyncManifest `json:"manifest"`
+	Calculated    int          `json:"calculated"`
+	CalculateDone bool         `json:"calculateDone"`
+
+	CloudRequires SyncManifest `json:"cloudRequires"`
+	NodeRequires  SyncManifest `json:"nodeRequires"`
+
+	// The latest unsynced local change to each object, from the change journal
+	Deltas map[string]*JournalEntry `json:"deltas"`
+
+	// Everything to push, delete or pull, and how many chunks of them are done
+	Transfers  []syncTransfer `json:"transfers"`
+	ChunksDone int            `json:"chunksDone"`
+}
+
+// syncTransfer is a single object to send to the cloud ("push"), remove from it ("delete"), or
+// fetch from it ("pull"). Changes from the journal carry the time they were made and, unless
+// they are deletes, the object as it was journalled.
+type syncTransfer struct {
+	ID   string          `json:"id"`
+	Op   string          `json:"op"`
+	Time int64           `json:"time,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+func newSyncPlan(manifest SyncManifest, deltas map[string]*JournalEntry, full bool) *syncPlan {
+	return &syncPlan{
+		Full:          full,
+		Started:       time.Now(),
+		Manifest:      manifest,
+		CloudRequires: make(SyncManifest),
+		NodeRequires:  make(SyncManifest),
+		Deltas:        deltas,
+	}
+}
+
+func (p *syncPlan) manifestIds() []string {
+	ids := make([]string, 0, len(p.Manifest))
+	for id := range p.Manifest {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// refresh brings a resumed plan up to date with the current manifest and journal. Objects changed
+// since the cloud was sent their time are pushed, and ones excluded since are dropped. It returns
+// whether the manifest changed.
+func (p *syncPlan) refresh(manifest SyncManifest, deltas map[string]*JournalEntry) bool {
+
+	// Calculated counts the sorted ids sent so far, so note the last of them before the ids change
+	ids := p.manifestIds()
+	sentUpTo := ""
+	if p.Calculated > 0 {
+		sentUpTo = ids[p.Calculated-1]
+	}
+
+	sent := func(id string) bool {
+		return p.CalculateDone || (sentUpTo != "" && id <= sentUpTo)
+	}
+
+	if p.Manifest == nil {
+		p.Manifest = make(SyncManifest)
+	}
+
+	changed := false
+
+	for id, t := range manifest {
+		if previous, ok := p.Manifest[id]; ok && previous == t {
+			continue
+		}
+
+		changed = true
+		p.Manifest[id] = t
+
+		if sent(id) {
+			// The cloud compared the old time (or nothing), so its answer is out of date
+			p.CloudRequires[id] = t
+			delete(p.NodeRequires, id)
+		}
+	}
+
+	for id := range p.Manifest {
+		if _, ok := manifest[id]; !ok {
+			changed = true
+			delete(p.Manifest, id)
+			delete(p.CloudRequires, id)
+			delete(p.NodeRequires, id)
+		}
+	}
+
+	if changed && sentUpTo != "" {
+		p.Calculated = 0
+		for _, id := range p.manifestIds() {
+			if id <= sentUpTo {
+				p.Calculated++
+			}
+		}
+	}
+
+	p.Deltas = deltas
+
+	return changed
+}
+
+// planTransfers works out the transfers from what the cloud and node require. They are sorted, so
+// the chunks are the same if the plan is rebuilt.
+func (p *syncPlan) planTransfers(deleteUnknown bool) {
+	p.Transfers = []syncTransfer{}
+
+	for id := range p.CloudRequires {
+		transfer := syncTransfer{ID: id, Op: "push"}
+
+		if delta, ok := p.Deltas[id]; ok {
+			transfer.Time = delta.Time.UnixNano() / int64(time.Millisecond)
+			transfer.Data = delta.Data
+			if delta.Op == "delete" {
+				transfer.Op = "delete"
+			}
+		}
+
+		p.Transfers = append(p.Transfers, transfer)
+	}
+
+	for id := range p.NodeRequires {
+		if _, ok := p.Manifest[id]; !ok && deleteUnknown {
+			p.Transfers = append(p.Transfers, syncTransfer{ID: id, Op: "delete"})
+		} else {
+			p.Transfers = append(p.Transfers, syncTransfer{ID: id, Op: "pull"})
+		}
+	}
+
+	sort.Sort(transfersByID(p.Transfers))
+	p.ChunksDone = 0
+}
+
+func (p *syncPlan) chunks() int {
+	return (len(p.Transfers) + chunkSize() - 1) / chunkSize()
+}
+
+func (p *syncPlan) chunk(i int) []syncTransfer {
+	end := (i + 1) * chunkSize()
+	if end > len(p.Transfers) {
+		end = len(p.Transfers)
+	}
+	return p.Transfers[i*chunkSize() : end]
+}
+
+func chunkSize() int {
+	if syncChunkSize < 1 {
+		return 1
+	}
+	return syncChunkSize
+}
+
+type transfersByID []syncTransfer
+
+func (a transfersByID) Len() int           { return len(a) }
+func (a transfersByID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a transfersByID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+// loadSyncPlan returns the unfinished full sync to resume, if there is a recent enough one
+func (m *baseModel) loadSyncPlan(conn redis.Conn) *syncPlan {
+	item, err := conn.Do("GET", m.idType+"s:syncPlan")
+	if err != nil {
+		m.log.Warningf("Failed to fetch %s sync plan: %s", m.idType, err)
+		return nil
+	}
+
+	if item == nil {
+		return nil
+	}
+
+	data, err := redis.Bytes(item, nil)
+	if err != nil {
+		m.log.Warningf("Failed to fetch %s sync plan: %s", m.idType, err)
+		return nil
+	}
+
+	plan := &syncPlan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		m.log.Warningf("Failed to unmarshal %s sync plan, starting again: %s", m.idType, err)
+		return nil
+	}
+
+	if !plan.Full || time.Since(plan.Started) > syncResumeWindow {
+		m.log.Infof("sync: Not resuming %s sync started at %s, it is too old", m.idType, plan.Started)
+		return nil
+	}
+
+	return plan
+}
+
+func (m *baseModel) saveSyncPlan(plan *syncPlan, conn redis.Conn) {
+	data, err := json.Marshal(plan)
+	if err == nil {
+		_, err = conn.Do("SET", m.idType+"s:syncPlan", data)
+	}
+
+	if err != nil {
+		// Not fatal, it only means this sync can't be resumed
+		m.log.Warningf("Failed to save %s sync plan: %s", m.idType, err)
+	}
+}
+
+func (m *baseModel) clearSyncPlan(conn redis.Conn) {
+	if _, err := conn.Do("DEL", m.idType+"s:syncPlan"); err != nil {
+		m.log.Warningf("Failed to clear %s sync plan: %s", m.idType, err)
+	}
+}
@@ -0,0 +1,243 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/config"
+	"github.com/ninjasphere/redigo/redis"
+)
+
+var syncPreviewTimeout = config.Duration(time.Second*30, "homecloud.sync.timeout")
+
+// SyncPreviewOptions let a preview show what a sync would do with different settings. They
+// default to homecloud.sync.fromCloud and homecloud.sync.deleteUnknownFromCloud.
+type SyncPreviewOptions struct {
+	FromCloud              *bool `json:"fromCloud,omitempty"`
+	DeleteUnknownFromCloud *bool `json:"deleteUnknownFromCloud,omitempty"`
+}
+
+// SyncPreview is what a sync of a model would do, without it having been done
+type SyncPreview struct {
+	Model                  string             `json:"model"`
+	FromCloud              bool               `json:"fromCloud"`
+	DeleteUnknownFromCloud bool               `json:"deleteUnknownFromCloud"`
+	Items                  []*SyncPreviewItem `json:"items"`
+}
+
+// SyncPreviewItem is what would happen to a single object. Action is one of
+//   "push"          - our version would be sent to the cloud
+//   "delete-remote" - the object would be deleted from the cloud
+//   "create"        - the cloud's version would be saved locally
+//   "overwrite"     - the cloud's version would replace ours
+//   "delete-local"  - the object would be deleted locally
+//   "keep-local"    - a conflict would be resolved in favour of our version, and it pushed
+//   "merge"         - a conflict would be resolved by merging, and the result pushed
+//   "ignore"        - the cloud has a newer version, but syncing from the cloud is disabled
+// Before and After are the cloud's version and ours for pushes, and ours and the resulting
+// version for everything else.
+type SyncPreviewItem struct {
+	ID       string                  `json:"id"`
+	Action   string                  `json:"action"`
+	Before   json.RawMessage         `json:"before"`
+	After    json.RawMessage         `json:"after"`
+	Changes  map[string]*FieldChange `json:"changes,omitempty"`
+	Conflict *SyncConflict           `json:"conflict,omitempty"`
+}
+
+// FieldChange is a single field that differs between Before and After
+type FieldChange struct {
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+// PreviewSync asks the cloud what is out of sync and reports what a sync would do about it.
+// Nothing is written, locally or to the cloud.
+func (m *baseModel) PreviewSync(options *SyncPreviewOptions, timeout time.Duration, conn redis.Conn) (*SyncPreview, error) {
+
+	if config.NoCloud() {
+		return nil, fmt.Errorf("There is no cloud to sync with")
+	}
+
+	preview := &SyncPreview{
+		Model:                  m.idType,
+		FromCloud:              enableSyncFromCloud,
+		DeleteUnknownFromCloud: deleteUnknownFromCloud,
+		Items:                  []*SyncPreviewItem{},
+	}
+
+	if options != nil && options.FromCloud != nil {
+		preview.FromCloud = *options.FromCloud
+	}
+	if options != nil && options.DeleteUnknownFromCloud != nil {
+		preview.DeleteUnknownFromCloud = *options.DeleteUnknownFromCloud
+	}
+
+	manifest, err := m.getSyncManifest(false, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffList SyncDifferenceList
+
+	calcClient := m.SyncConn.Conn.GetServiceClient("$ninja/services/rpc/modelstore/calculate_sync_items")
+	if err := calcClient.Call("modelstore.calculate_sync_items", []interface{}{m.idType, manifest}, &diffList, timeout); err != nil {
+		return nil, fmt.Errorf("Failed calling calculate_sync_items for model %s error:%s", m.idType, err)
+	}
+
+	m.dropExcluded(&diffList, false, conn)
+
+	if len(diffList.CloudRequires)+len(diffList.NodeRequires) == 0 {
+		return preview, nil
+	}
+
+	// Ask for the cloud's version of everything, pushing nothing, so we can show the differences
+	requestIds := make([]string, 0)
+	for id := range diffList.NodeRequires {
+		requestIds = append(requestIds, id)
+	}
+	for id := range diffList.CloudRequires {
+		requestIds = append(requestIds, id)
+	}
+
+	var syncReply SyncReply
+
+	syncClient := m.SyncConn.Conn.GetServiceClient("$ninja/services/rpc/modelstore/do_sync_items")
+	if err := syncClient.Call("modelstore.do_sync_items", []interface{}{m.idType, SyncDataSet{}, requestIds}, &syncReply, timeout); err != nil {
+		return nil, fmt.Errorf("Failed calling do_sync_items for model %s error:%s", m.idType, err)
+	}
+
+	cloudVersion := func(id string) json.RawMessage {
+		if obj, ok := syncReply.RequestedObjects[id]; ok && len(obj.Data) > 0 {
+			return obj.Data
+		}
+		return json.RawMessage("null")
+	}
+
+	for id := range diffList.CloudRequires {
+		obj := reflect.New(m.objType).Interface()
+
+		item := &SyncPreviewItem{ID: id, Action: "push", Before: cloudVersion(id), After: json.RawMessage("null")}
+
+		err := m.fetch(id, obj, true, conn)
+		if err == RecordNotFound {
+			item.Action = "delete-remote"
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed retrieving %s id:%s error:%s", m.idType, id, err)
+		} else if item.After, err = json.Marshal(obj); err != nil {
+			return nil, err
+		}
+
+		preview.add(item)
+	}
+
+	for id := range diffList.NodeRequires {
+
+		if _, ok := (*manifest)[id]; !ok && preview.DeleteUnknownFromCloud {
+			preview.add(&SyncPreviewItem{ID: id, Action: "delete-remote", Before: cloudVersion(id), After: json.RawMessage("null")})
+			continue
+		}
+
+		requestedObj, ok := syncReply.RequestedObjects[id]
+		if !ok {
+			continue
+		}
+
+		obj := reflect.New(m.objType).Interface()
+		if err := json.Unmarshal(requestedObj.Data, obj); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal requested %s id:%s error: %s", m.idType, id, err)
+		}
+
+		d, err := m.decideRequested(id, requestedObj, obj, conn)
+		if err != nil {
+			return nil, err
+		}
+
+		item := &SyncPreviewItem{ID: id, Before: d.local, After: d.cloud, Conflict: d.conflict}
+
+		switch {
+		case !preview.FromCloud:
+			item.Action = "ignore"
+		case d.resolution == "local":
+			item.Action = "keep-local"
+			item.After = d.local
+		case d.resolution == "merged":
+			item.Action = "merge"
+			item.After = d.merged
+		case isNull(d.cloud):
+			item.Action = "delete-local"
+		case isNull(d.local):
+			item.Action = "create"
+		default:
+			item.Action = "overwrite"
+		}
+
+		preview.add(item)
+	}
+
+	sort.Sort(previewItemsByID(preview.Items))
+
+	return preview, nil
+}
+
+func (p *SyncPreview) add(item *SyncPreviewItem) {
+	item.Changes = diffFields(item.Before, item.After)
+	p.Items = append(p.Items, item)
+}
+
+// diffFields lists the top level fields that differ between two versions of an object
+func diffFields(before, after json.RawMessage) map[string]*FieldChange {
+	var b, a map[string]json.RawMessage
+
+	// Either may be null (or not an object), in which case every field of the other one changed
+	json.Unmarshal(before, &b)
+	json.Unmarshal(after, &a)
+
+	changes := make(map[string]*FieldChange)
+
+	for field := range b {
+		if fieldValue(b, field) != fieldValue(a, field) {
+			changes[field] = &FieldChange{json.RawMessage(fieldValue(b, field)), json.RawMessage(fieldValue(a, field))}
+		}
+	}
+	for field := range a {
+		if _, ok := b[field]; !ok && fieldValue(a, field) != "null" {
+			changes[field] = &FieldChange{json.RawMessage("null"), a[field]}
+		}
+	}
+
+	return changes
+}
+
+type previewItemsByID []*SyncPreviewItem
+
+func (a previewItemsByID) Len() int           { return len(a) }
+func (a previewItemsByID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a previewItemsByID) Less(i, j int) bool { return a[i].ID < a[j].ID }
+
+// PreviewSync reports what syncing a model (i.e. "thing") would do, or every model if none is given
+func (m *SyncMonitor) PreviewSync(model string, options *SyncPreviewOptions, conn redis.Conn) (map[string]*SyncPreview, error) {
+
+	previews := make(map[string]*SyncPreview)
+
+	for _, b := range m.synced() {
+		if model != "" && model != b.idType {
+			continue
+		}
+
+		preview, err := b.PreviewSync(options, syncPreviewTimeout, conn)
+		if err != nil {
+			return nil, err
+		}
+		previews[b.idType] = preview
+	}
+
+	if len(previews) == 0 {
+		return nil, RecordNotFound
+	}
+
+	return previews, nil
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+
+	"github.com/ninjasphere/go-ninja/config"
+)
+
+var syncSecretKey = config.String("", "homecloud.sync.secretKey")
+
+var NoSecretKey = errors.New("No homecloud.sync.secretKey to decrypt secrets with")
+
+// encryptSecret encrypts a secret (i.e. a module's config) with AES-GCM, using a key derived from
+// homecloud.sync.secretKey, and returns it base64 encoded. It returns "" if there is no key.
+//
+// The nonce is derived from the secret, so the same secret always encrypts the same way and
+// doesn't look like a change to sync every time.
+func encryptSecret(secret []byte) (string, error) {
+	if syncSecretKey == "" {
+		return "", nil
+	}
+
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, []byte(syncSecretKey))
+	mac.Write(secret)
+	nonce := mac.Sum(nil)[:gcm.NonceSize()]
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, secret, nil)), nil
+}
+
+func decryptSecret(encrypted string) ([]byte, error) {
+	if syncSecretKey == "" {
+		return nil, NoSecretKey
+	}
+
+	gcm, err := secretCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("Encrypted secret is too short")
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func secretCipher() (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(syncSecretKey))
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
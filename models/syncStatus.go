@@ -0,0 +1,257 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/logger"
+	"github.com/ninjasphere/redigo/redis"
+)
+
+// SyncStatus is how syncing a model with the cloud is going. Pushed and Pulled are the number of
+// objects sent and received by the last successful sync. Pending is the number of changes that
+// haven't been pushed yet. Progress is how far a sync that is running has got.
+type SyncStatus struct {
+	Model       string        `json:"model"`
+	InSync      bool          `json:"inSync"`
+	LastAttempt *time.Time    `json:"lastAttempt,omitempty"`
+	LastSuccess *time.Time    `json:"lastSuccess,omitempty"`
+	LastError   string        `json:"lastError,omitempty"`
+	LastErrorAt *time.Time    `json:"lastErrorAt,omitempty"`
+	LastRun     string        `json:"lastRun,omitempty"` // "full" or "changes"
+	Pushed      int           `json:"pushed"`
+	Pulled      int           `json:"pulled"`
+	Pending     int           `json:"pending"`
+	Progress    *SyncProgress `json:"progress,omitempty"`
+}
+
+// SyncProgress is how many chunks of a sync phase are done. Phase is "manifest" while working out
+// what is out of sync, then "transfer" while objects are pushed and pulled.
+type SyncProgress struct {
+	Phase string `json:"phase"`
+	Done  int    `json:"done"`
+	Total int    `json:"total"`
+}
+
+// SyncMonitor records the outcome of each model's syncs, and announces it as a "status" event.
+// It is also how syncs are previewed, or asked for, from outside homecloud.
+type SyncMonitor struct {
+	sync.Mutex
+
+	RoomModel    *RoomModel    `inject:""`
+	DeviceModel  *DeviceModel  `inject:""`
+	ChannelModel *ChannelModel `inject:""`
+	ThingModel   *ThingModel   `inject:""`
+	SiteModel    *SiteModel    `inject:""`
+	FloorModel   *FloorModel   `inject:""`
+	ModuleModel  *ModuleModel  `inject:""`
+
+	log       *logger.Logger
+	pending   map[string]func() int
+	trigger   func()
+	sendEvent func(event string, payload interface{}) error
+}
+
+func NewSyncMonitor() *SyncMonitor {
+	return &SyncMonitor{
+		log:     logger.GetLogger("SyncMonitor"),
+		pending: make(map[string]func() int),
+	}
+}
+
+// synced returns every model that is synced with the cloud
+func (m *SyncMonitor) synced() []*baseModel {
+	return []*baseModel{
+		&m.RoomModel.baseModel,
+		&m.DeviceModel.baseModel,
+		&m.ChannelModel.baseModel,
+		&m.ThingModel.baseModel,
+		&m.SiteModel.baseModel,
+		&m.FloorModel.baseModel,
+		&m.ModuleModel.baseModel,
+	}
+}
+
+func (m *SyncMonitor) setPendingCounter(model string, counter func() int) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.pending[model] = counter
+}
+
+func (m *SyncMonitor) started(model string, conn redis.Conn) {
+	status, err := m.FetchStatus(model, conn)
+	if err != nil {
+		m.log.Warningf("Failed to fetch sync status of %ss: %s", model, err)
+		return
+	}
+
+	now := time.Now()
+	status.LastAttempt = &now
+
+	if err := m.save(status, conn); err != nil {
+		m.log.Warningf("Failed to save sync status of %ss: %s", model, err)
+	}
+}
+
+func (m *SyncMonitor) finished(model string, full bool, pushed, pulled int, syncErr error, conn redis.Conn) {
+	status, err := m.FetchStatus(model, conn)
+	if err != nil {
+		m.log.Warningf("Failed to fetch sync status of %ss: %s", model, err)
+		return
+	}
+
+	now := time.Now()
+
+	status.Progress = nil
+
+	status.LastRun = "changes"
+	if full {
+		status.LastRun = "full"
+	}
+
+	if syncErr != nil {
+		status.LastError = syncErr.Error()
+		status.LastErrorAt = &now
+	} else {
+		status.LastError = ""
+		status.LastSuccess = &now
+		status.Pushed = pushed
+		status.Pulled = pulled
+	}
+
+	if err := m.save(status, conn); err != nil {
+		m.log.Warningf("Failed to save sync status of %ss: %s", model, err)
+	}
+
+	m.Lock()
+	sendEvent := m.sendEvent
+	m.Unlock()
+
+	if sendEvent != nil {
+		if err := sendEvent("status", m.withPending(status)); err != nil {
+			m.log.Warningf("Failed to send sync status of %ss: %s", model, err)
+		}
+	}
+}
+
+// progress records how far a running sync has got, and announces it as a "progress" event
+func (m *SyncMonitor) progress(model string, phase string, done, total int, conn redis.Conn) {
+	status, err := m.FetchStatus(model, conn)
+	if err != nil {
+		m.log.Warningf("Failed to fetch sync status of %ss: %s", model, err)
+		return
+	}
+
+	status.Progress = &SyncProgress{phase, done, total}
+
+	if err := m.save(status, conn); err != nil {
+		m.log.Warningf("Failed to save sync status of %ss: %s", model, err)
+	}
+
+	m.Lock()
+	sendEvent := m.sendEvent
+	m.Unlock()
+
+	if sendEvent != nil {
+		if err := sendEvent("progress", status); err != nil {
+			m.log.Warningf("Failed to send sync progress of %ss: %s", model, err)
+		}
+	}
+}
+
+func (m *SyncMonitor) save(status *SyncStatus, conn redis.Conn) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("HSET", "sync:status", status.Model, data)
+	return err
+}
+
+func (m *SyncMonitor) withPending(status *SyncStatus) *SyncStatus {
+	m.Lock()
+	counter, ok := m.pending[status.Model]
+	m.Unlock()
+
+	status.Pending = 0
+	if ok {
+		status.Pending = counter()
+	}
+
+	status.InSync = status.LastSuccess != nil && status.LastError == "" && status.Pending == 0
+
+	return status
+}
+
+// FetchStatus returns the sync status of a single model, i.e. "thing"
+func (m *SyncMonitor) FetchStatus(model string, conn redis.Conn) (*SyncStatus, error) {
+	item, err := conn.Do("HGET", "sync:status", model)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &SyncStatus{Model: model}
+
+	if item != nil {
+		data, err := redis.Bytes(item, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, status); err != nil {
+			return nil, err
+		}
+	}
+
+	return m.withPending(status), nil
+}
+
+// FetchAllStatus returns the sync status of every model that has tried to sync, keyed by model
+func (m *SyncMonitor) FetchAllStatus(conn redis.Conn) (map[string]*SyncStatus, error) {
+	models, err := redis.Strings(conn.Do("HKEYS", "sync:status"))
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make(map[string]*SyncStatus)
+
+	for _, model := range models {
+		if statuses[model], err = m.FetchStatus(model, conn); err != nil {
+			return nil, err
+		}
+	}
+
+	return statuses, nil
+}
+
+// SetSyncTrigger is called by SyncNow
+func (m *SyncMonitor) SetSyncTrigger(trigger func()) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.trigger = trigger
+}
+
+// SyncNow asks for every model to be synced straight away, even if syncing has been backing off
+func (m *SyncMonitor) SyncNow() error {
+	m.Lock()
+	trigger := m.trigger
+	m.Unlock()
+
+	if trigger == nil {
+		return errors.New("Syncing is disabled")
+	}
+
+	trigger()
+	return nil
+}
+
+func (m *SyncMonitor) SetEventHandler(handler func(event string, payload interface{}) error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.sendEvent = handler
+}
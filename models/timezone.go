@@ -0,0 +1,58 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bradfitz/latlong"
+)
+
+type timezone struct {
+	TimeZoneID   string // IANA zone, i.e. "Australia/Sydney"
+	TimeZoneName string // Also the IANA zone, as clients expect a full name rather than "AEDT"
+	Offset       int    // Current offset from UTC in seconds, including DST
+	RawOffset    int    // Standard offset from UTC in seconds
+	DST          bool
+}
+
+// getTimezone resolves a location to its timezone using the embedded timezone boundaries,
+// so it works without a network connection.
+func getTimezone(latitude, longitude float64) (*timezone, error) {
+
+	zone := latlong.LookupZoneName(latitude, longitude)
+
+	if zone == "" {
+		return nil, fmt.Errorf("No timezone found at (%0.4f, %0.4f)", latitude, longitude)
+	}
+
+	return getTimezoneAt(zone, time.Now())
+}
+
+// getTimezoneAt calculates the offset of a timezone at a given time from the tz database
+func getTimezoneAt(zone string, t time.Time) (*timezone, error) {
+
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown timezone %s: %s", zone, err)
+	}
+
+	_, offset := t.In(location).Zone()
+
+	// The standard offset is the smaller of the two offsets either side of the year,
+	// which works for both hemispheres (and for zones without DST).
+	_, january := time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, location).Zone()
+	_, july := time.Date(t.Year(), time.July, 1, 0, 0, 0, 0, location).Zone()
+
+	rawOffset := january
+	if july < rawOffset {
+		rawOffset = july
+	}
+
+	return &timezone{
+		TimeZoneID:   zone,
+		TimeZoneName: zone,
+		Offset:       offset,
+		RawOffset:    rawOffset,
+		DST:          offset != rawOffset,
+	}, nil
+}
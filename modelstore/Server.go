@@ -0,0 +1,139 @@
+package modelstore
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ninjasphere/go-ninja/api"
+	"github.com/ninjasphere/go-ninja/logger"
+	"github.com/ninjasphere/sphere-go-homecloud/models"
+)
+
+const (
+	calculateSyncItemsTopic = "$ninja/services/rpc/modelstore/calculate_sync_items"
+	doSyncItemsTopic        = "$ninja/services/rpc/modelstore/do_sync_items"
+)
+
+// Server answers the modelstore RPC calls that homecloud makes when syncing, from a local Store
+type Server struct {
+	conn  *ninja.Connection
+	store *Store
+	log   *logger.Logger
+}
+
+func NewServer(conn *ninja.Connection, store *Store) *Server {
+	return &Server{
+		conn:  conn,
+		store: store,
+		log:   logger.GetLogger("ModelStore"),
+	}
+}
+
+type rpcRequest struct {
+	ID     interface{}       `json:"id"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcReply struct {
+	Version string      `json:"jsonrpc"`
+	ID      interface{} `json:"id"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   *rpcError   `json:"error,omitempty"`
+}
+
+// Start listens for calculate_sync_items and do_sync_items calls
+func (s *Server) Start() error {
+
+	err := s.handle(calculateSyncItemsTopic, func(params []json.RawMessage) (interface{}, error) {
+		var model string
+		var manifest models.SyncManifest
+
+		if len(params) != 2 {
+			return nil, fmt.Errorf("Expected [model, manifest], got %d params", len(params))
+		}
+		if err := json.Unmarshal(params[0], &model); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(params[1], &manifest); err != nil {
+			return nil, err
+		}
+
+		diffList := s.store.CalculateSyncItems(model, manifest)
+
+		s.log.Infof("calculate_sync_items %s: cloud requires %d, node requires %d", model, len(diffList.CloudRequires), len(diffList.NodeRequires))
+
+		return diffList, nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return s.handle(doSyncItemsTopic, func(params []json.RawMessage) (interface{}, error) {
+		var model string
+		var pushed map[string]models.SyncRawObject
+		var requested []string
+
+		if len(params) != 3 {
+			return nil, fmt.Errorf("Expected [model, pushed objects, requested ids], got %d params", len(params))
+		}
+		if err := json.Unmarshal(params[0], &model); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(params[1], &pushed); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(params[2], &requested); err != nil {
+			return nil, err
+		}
+
+		s.log.Infof("do_sync_items %s: %d pushed, %d requested", model, len(pushed), len(requested))
+
+		return s.store.DoSyncItems(model, pushed, requested)
+	})
+}
+
+func (s *Server) handle(topic string, call func(params []json.RawMessage) (interface{}, error)) error {
+
+	_, err := s.conn.SubscribeRaw(topic, func(payload *json.RawMessage, values map[string]string) bool {
+
+		request := &rpcRequest{}
+		if err := json.Unmarshal(*payload, request); err != nil {
+			s.log.Warningf("Could not parse request on %s error: %s", topic, err)
+			return true
+		}
+
+		if request.Method == "" {
+			// Not a request, i.e. our own reply
+			return true
+		}
+
+		reply := &rpcReply{Version: "2.0", ID: request.ID}
+
+		result, err := call(request.Params)
+		if err != nil {
+			s.log.Errorf("Failed %s error: %s", request.Method, err)
+			reply.Error = &rpcError{Code: -32000, Message: err.Error()}
+		} else {
+			reply.Result = result
+		}
+
+		replyPayload, err := json.Marshal(reply)
+		if err != nil {
+			s.log.Errorf("Failed to serialise reply to %s error: %s", request.Method, err)
+			return true
+		}
+
+		s.conn.GetMqttClient().Publish(topic+"/reply", replyPayload)
+
+		return true
+	})
+
+	return err
+}
@@ -0,0 +1,157 @@
+package modelstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/ninjasphere/sphere-go-homecloud/models"
+)
+
+// Item is the latest version of an object pushed by a sphere. Data is null once it has been deleted.
+type Item struct {
+	Data         json.RawMessage `json:"data"`
+	LastModified int64           `json:"last_modified"`
+}
+
+// Store is a stand-in for the cloud's modelstore. It keeps the latest version of every object
+// pushed to it, and works out what needs to be exchanged the same way the cloud does: whichever
+// side has the newer last modified time wins.
+type Store struct {
+	sync.Mutex
+	file   string
+	models map[string]map[string]*Item // model -> id -> item
+}
+
+// NewStore loads the store from a file, if it exists. Every change is written back to it.
+// If file is empty, the store is only kept in memory.
+func NewStore(file string) (*Store, error) {
+	s := &Store{
+		file:   file,
+		models: make(map[string]map[string]*Item),
+	}
+
+	if file == "" {
+		return s, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.models); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Store) items(model string) map[string]*Item {
+	if _, ok := s.models[model]; !ok {
+		s.models[model] = make(map[string]*Item)
+	}
+	return s.models[model]
+}
+
+// CalculateSyncItems compares a sphere's manifest (id -> last modified) with the store
+func (s *Store) CalculateSyncItems(model string, manifest models.SyncManifest) *models.SyncDifferenceList {
+	s.Lock()
+	defer s.Unlock()
+
+	diffList := &models.SyncDifferenceList{
+		Model:         model,
+		CloudRequires: make(models.SyncManifest),
+		NodeRequires:  make(models.SyncManifest),
+	}
+
+	items := s.items(model)
+
+	for id, lastModified := range manifest {
+		item, ok := items[id]
+		switch {
+		case !ok || item.LastModified < lastModified:
+			diffList.CloudRequires[id] = lastModified
+		case item.LastModified > lastModified:
+			diffList.NodeRequires[id] = item.LastModified
+		}
+	}
+
+	for id, item := range items {
+		if _, ok := manifest[id]; !ok && !isDeleted(item) {
+			// Deletions are only interesting to spheres that have the object
+			diffList.NodeRequires[id] = item.LastModified
+		}
+	}
+
+	return diffList
+}
+
+// DoSyncItems stores the objects pushed by a sphere (unless we already have something newer),
+// and replies with the objects it requested
+func (s *Store) DoSyncItems(model string, pushed map[string]models.SyncRawObject, requested []string) (*models.SyncReply, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	reply := &models.SyncReply{
+		Model:            model,
+		RequestedObjects: make(map[string]models.SyncRawObject),
+		PushedObjects:    make(models.SyncDataSet),
+	}
+
+	items := s.items(model)
+
+	for id, obj := range pushed {
+		if existing, ok := items[id]; ok && existing.LastModified > obj.LastModified {
+			continue
+		}
+
+		data := obj.Data
+		if len(data) == 0 {
+			data = json.RawMessage("null")
+		}
+
+		items[id] = &Item{data, obj.LastModified}
+		reply.PushedObjects[id] = obj
+	}
+
+	for _, id := range requested {
+		if item, ok := items[id]; ok {
+			reply.RequestedObjects[id] = models.SyncRawObject{Data: item.Data, LastModified: item.LastModified}
+		}
+	}
+
+	if len(pushed) > 0 {
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	return reply, nil
+}
+
+func (s *Store) save() error {
+	if s.file == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.models, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename, so a crash can't leave a half-written store
+	if err := ioutil.WriteFile(s.file+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(s.file+".tmp", s.file)
+}
+
+func isDeleted(item *Item) bool {
+	return len(item.Data) == 0 || string(item.Data) == "null"
+}
@@ -0,0 +1,244 @@
+package presence
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/api"
+	"github.com/ninjasphere/go-ninja/logger"
+	"github.com/ninjasphere/redigo/redis"
+	"github.com/ninjasphere/sphere-go-homecloud/models"
+)
+
+// Only things of these types are moved between rooms by location updates
+var presenceThingTypes = map[string]bool{
+	"person": true,
+	"tag":    true,
+}
+
+type locationUpdate struct {
+	Zone *string `json:"zone,omitempty"`
+}
+
+// Occupant is a thing that is in a room, and when it arrived
+type Occupant struct {
+	ThingID string    `json:"thingId"`
+	Name    string    `json:"name"`
+	Since   time.Time `json:"since"`
+}
+
+// Occupancy is who is in a room
+type Occupancy struct {
+	RoomID    string      `json:"roomId"`
+	Occupants []*Occupant `json:"occupants"`
+}
+
+// PresenceManager follows the zone updates from the location service, moving people
+// and tags between rooms, and keeping track of who is in each room. Who is in each room is
+// only kept in memory, so it is empty again after a restart until location updates arrive.
+type PresenceManager struct {
+	sync.Mutex
+	Conn       *ninja.Connection  `inject:""`
+	Pool       *redis.Pool        `inject:""`
+	ThingModel *models.ThingModel `inject:""`
+	RoomModel  *models.RoomModel  `inject:""`
+	log        *logger.Logger
+	rooms      map[string]map[string]*Occupant // roomID -> thingID -> occupant
+}
+
+func NewPresenceManager() *PresenceManager {
+	return &PresenceManager{
+		log:   logger.GetLogger("PresenceManager"),
+		rooms: make(map[string]map[string]*Occupant),
+	}
+}
+
+func (p *PresenceManager) PostConstruct() error {
+
+	_, err := p.Conn.GetMqttClient().Subscribe("$device/+/+/location", func(topic string, payload []byte) {
+		values, err := ninja.MatchTopicPattern("$device/:device/:channel/location", topic)
+		if err != nil {
+			p.log.Warningf("Failed to parse location topic %s : %s", topic, err)
+			return
+		}
+
+		update := &locationUpdate{}
+		if err := json.Unmarshal(payload, update); err != nil {
+			p.log.Errorf("Failed to parse location update %s to %s : %s", payload, topic, err)
+			return
+		}
+
+		p.handleLocationUpdate((*values)["device"], update)
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = p.Conn.SubscribeRaw("$room/:room/event/goodbye", func(payload *json.RawMessage, values map[string]string) bool {
+		p.Lock()
+		delete(p.rooms, values["room"])
+		p.Unlock()
+		return true
+	})
+
+	return err
+}
+
+func (p *PresenceManager) handleLocationUpdate(deviceID string, update *locationUpdate) {
+
+	conn := p.Pool.Get()
+	defer conn.Close()
+
+	thing, err := p.ThingModel.FetchByDeviceId(deviceID, conn)
+	if err == models.RecordNotFound {
+		p.log.Debugf("Device %s is not attached to a thing. Ignoring.", deviceID)
+		return
+	}
+	if err != nil {
+		p.log.Warningf("Failed to fetch thing by device id %s error: %s", deviceID, err)
+		return
+	}
+
+	if !presenceThingTypes[thing.Type] {
+		p.log.Debugf("Thing %s (%s) is a %s, not moving it.", thing.ID, thing.Name, thing.Type)
+		return
+	}
+
+	if update.Zone == nil {
+		p.log.Debugf("< Incoming location update: device %s not in a zone", deviceID)
+
+		// They've left, but we leave the thing's location as the last room they were seen in.
+		p.leave(thing.ID)
+		return
+	}
+
+	p.log.Debugf("< Incoming location update: device %s is in zone %s", deviceID, *update.Zone)
+
+	if _, err := p.RoomModel.Fetch(*update.Zone, conn); err != nil {
+		if err == models.RecordNotFound {
+			p.log.Infof("Unknown room %s. Advising remote location service to forget it.", *update.Zone)
+			payload, _ := json.Marshal(map[string]string{"zone": *update.Zone})
+			p.Conn.GetMqttClient().Publish("$location/delete", payload)
+		} else {
+			p.log.Warningf("Failed to fetch room %s error: %s", *update.Zone, err)
+		}
+		return
+	}
+
+	if thing.Location == nil || *thing.Location != *update.Zone {
+		p.log.Debugf("Thing %s (%s) (Device %s) moved from %v to %s", thing.ID, thing.Name, deviceID, thing.Location, *update.Zone)
+
+		if err := p.ThingModel.SetLocation(thing.ID, update.Zone, conn); err != nil {
+			p.log.Warningf("Failed to update location of thing %s error: %s", thing.ID, err)
+			return
+		}
+	}
+
+	p.enter(thing.ID, thing.Name, *update.Zone)
+}
+
+// enter records a thing as being in a room, publishing the change if it moved
+func (p *PresenceManager) enter(thingID, name, roomID string) {
+	p.Lock()
+
+	if occupants, ok := p.rooms[roomID]; ok {
+		if _, ok := occupants[thingID]; ok {
+			// Already here
+			p.Unlock()
+			return
+		}
+	}
+
+	changed := p.removeLocked(thingID)
+
+	if _, ok := p.rooms[roomID]; !ok {
+		p.rooms[roomID] = make(map[string]*Occupant)
+	}
+	p.rooms[roomID][thingID] = &Occupant{ThingID: thingID, Name: name, Since: time.Now()}
+	changed = append(changed, roomID)
+
+	p.Unlock()
+
+	p.publish(changed...)
+}
+
+// leave records a thing as not being in any room
+func (p *PresenceManager) leave(thingID string) {
+	p.Lock()
+	changed := p.removeLocked(thingID)
+	p.Unlock()
+
+	p.publish(changed...)
+}
+
+func (p *PresenceManager) removeLocked(thingID string) []string {
+	changed := []string{}
+
+	for roomID, occupants := range p.rooms {
+		if _, ok := occupants[thingID]; ok {
+			delete(occupants, thingID)
+			changed = append(changed, roomID)
+		}
+	}
+
+	return changed
+}
+
+func (p *PresenceManager) publish(roomIDs ...string) {
+	for _, roomID := range roomIDs {
+		occupancy := p.GetOccupancy(roomID)
+
+		if err := p.Conn.SendNotification(fmt.Sprintf("$room/%s/event/occupancy", roomID), occupancy); err != nil {
+			p.log.Warningf("Failed to publish occupancy of room %s error: %s", roomID, err)
+		}
+	}
+}
+
+// GetOccupancy returns who is in a room, longest there first
+func (p *PresenceManager) GetOccupancy(roomID string) *Occupancy {
+	p.Lock()
+	defer p.Unlock()
+
+	occupancy := &Occupancy{
+		RoomID:    roomID,
+		Occupants: []*Occupant{},
+	}
+
+	for _, occupant := range p.rooms[roomID] {
+		o := *occupant
+		occupancy.Occupants = append(occupancy.Occupants, &o)
+	}
+
+	sort.Sort(bySince(occupancy.Occupants))
+
+	return occupancy
+}
+
+// GetAllOccupancy returns the occupancy of every room that has (or has had) someone in it
+func (p *PresenceManager) GetAllOccupancy() []*Occupancy {
+	p.Lock()
+	roomIDs := make([]string, 0, len(p.rooms))
+	for roomID := range p.rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	p.Unlock()
+
+	sort.Strings(roomIDs)
+
+	all := make([]*Occupancy, len(roomIDs))
+	for i, roomID := range roomIDs {
+		all[i] = p.GetOccupancy(roomID)
+	}
+
+	return all
+}
+
+type bySince []*Occupant
+
+func (a bySince) Len() int           { return len(a) }
+func (a bySince) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a bySince) Less(i, j int) bool { return a[i].Since.Before(a[j].Since) }
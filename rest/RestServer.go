@@ -10,20 +10,32 @@ import (
 	"github.com/ninjasphere/go-ninja/config"
 	"github.com/ninjasphere/go-ninja/logger"
 	"github.com/ninjasphere/redigo/redis"
+	"github.com/ninjasphere/sphere-go-homecloud/capabilities"
+	"github.com/ninjasphere/sphere-go-homecloud/location"
 	"github.com/ninjasphere/sphere-go-homecloud/models"
+	"github.com/ninjasphere/sphere-go-homecloud/presence"
 	"github.com/ninjasphere/sphere-go-homecloud/state"
 )
 
 // RestServer Holds stuff shared by all the rest services
 type RestServer struct {
-	RedisPool    *redis.Pool         `inject:""`
-	Conn         *ninja.Connection   `inject:""`
-	RoomModel    *models.RoomModel   `inject:""`
-	ThingModel   *models.ThingModel  `inject:""`
-	DeviceModel  *models.DeviceModel `inject:""`
-	SiteModel    *models.SiteModel   `inject:""`
-	StateManager state.StateManager  `inject:""`
-	log          *logger.Logger
+	RedisPool       *redis.Pool               `inject:""`
+	Conn            *ninja.Connection         `inject:""`
+	RoomModel       *models.RoomModel         `inject:""`
+	ThingModel      *models.ThingModel        `inject:""`
+	DeviceModel     *models.DeviceModel       `inject:""`
+	SiteModel       *models.SiteModel         `inject:""`
+	FloorModel      *models.FloorModel        `inject:""`
+	ModuleModel     *models.ModuleModel       `inject:""`
+	QuarantineModel *models.QuarantineModel   `inject:""`
+	ConflictLog     *models.ConflictLog       `inject:""`
+	SyncMonitor     *models.SyncMonitor       `inject:""`
+	SyncExclusions  *models.SyncExclusions    `inject:""`
+	StateManager    state.StateManager        `inject:""`
+	Capabilities    *capabilities.Catalogue   `inject:""`
+	LocationManager location.LocationManager  `inject:""`
+	PresenceManager *presence.PresenceManager `inject:""`
+	log             *logger.Logger
 }
 
 func (r *RestServer) PostConstruct() error {
@@ -43,8 +55,17 @@ func (r *RestServer) Listen() error {
 	m.Map(r.ThingModel)
 	m.Map(r.DeviceModel)
 	m.Map(r.SiteModel)
+	m.Map(r.FloorModel)
+	m.Map(r.ModuleModel)
+	m.Map(r.QuarantineModel)
+	m.Map(r.ConflictLog)
+	m.Map(r.SyncMonitor)
+	m.Map(r.SyncExclusions)
 	m.Map(r.Conn)
 	m.Map(r.StateManager)
+	m.Map(r.Capabilities)
+	m.Map(r.LocationManager)
+	m.Map(r.PresenceManager)
 
 	m.Use(func(c martini.Context) {
 		conn := r.RedisPool.Get()
@@ -59,11 +80,22 @@ func (r *RestServer) Listen() error {
 	thing := NewThingRouter()
 	room := NewRoomRouter()
 	site := NewSiteRouter()
+	floor := NewFloorRouter()
+	device := NewDeviceRouter()
+	quarantine := NewQuarantineRouter()
+	occupancy := NewOccupancyRouter()
+	sync := NewSyncRouter()
 
 	m.Group("/rest/v1/locations", location.Register)
 	m.Group("/rest/v1/things", thing.Register)
 	m.Group("/rest/v1/rooms", room.Register)
 	m.Group("/rest/v1/sites", site.Register)
+	m.Group("/rest/v1/floors", floor.Register)
+	m.Get("/rest/v1/capabilities", GetCapabilities)
+	m.Group("/rest/v1/occupancy", occupancy.Register)
+	m.Group("/rest/v1/devices", device.Register)
+	m.Group("/rest/v1/quarantine", quarantine.Register)
+	m.Group("/rest/v1/sync", sync.Register)
 
 	listenAddress := fmt.Sprintf(":%d", config.MustInt("homecloud.rest.port"))
 
@@ -0,0 +1,27 @@
+package rest
+
+import (
+	"net/http"
+
+	"github.com/ninjasphere/redigo/redis"
+	"github.com/ninjasphere/sphere-go-homecloud/capabilities"
+)
+
+// GetCapabilities lists the things that support each channel protocol
+//
+// Response
+// {
+//    "on-off" : ["4b518a5d-f855-4e21-86e0-6e91f6772bea", "525425b8-7d8e-4da9-9317-a38dd447ece7"],
+//    "temperature" : ["8252f0e2-43d5-4dd2-bf13-834af1b789ca"]
+// }
+//
+func GetCapabilities(w http.ResponseWriter, catalogue *capabilities.Catalogue, conn redis.Conn) {
+	protocols, err := catalogue.FetchSiteCapabilities(conn)
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve capabilities", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(protocols, http.StatusOK, w)
+}
@@ -0,0 +1,122 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-martini/martini"
+	"github.com/ninjasphere/redigo/redis"
+	"github.com/ninjasphere/sphere-go-homecloud/models"
+)
+
+type DeviceRouter struct {
+}
+
+func NewDeviceRouter() *DeviceRouter {
+	return &DeviceRouter{}
+}
+
+func (lr *DeviceRouter) Register(r martini.Router) {
+
+	r.Get("/pending", lr.GetPending)
+	r.Post("/pending/:id/approve", lr.PostApprove)
+	r.Post("/pending/:id/reject", lr.PostReject)
+	r.Delete("/blacklist/:naturalId", lr.DeleteBlacklisted)
+
+}
+
+// GetPending retrieves the newly announced devices that are waiting for approval
+//
+// Response
+// [
+//    {
+//       "device" : {
+//          "id" : "2864dd823a",
+//          "naturalId" : "F0E4FFFFFFFF",
+//          "naturalIdType" : "ble",
+//          "name" : "Tag"
+//       },
+//       "received" : "2015-01-05T10:01:17.041Z"
+//    }
+// ]
+//
+func (lr *DeviceRouter) GetPending(w http.ResponseWriter, deviceModel *models.DeviceModel, conn redis.Conn) {
+	devices, err := deviceModel.FetchAllPending(conn)
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve pending devices", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(devices, http.StatusOK, w)
+}
+
+// PostApprove creates a thing for a pending device
+//
+// Request {"name":"Bedroom Lamp","type":"light","roomId":"1468fbcd-3ca6-4c6f-a742-ab91221e5462"}
+// Response the created thing
+//
+func (lr *DeviceRouter) PostApprove(params martini.Params, r *http.Request, w http.ResponseWriter, deviceModel *models.DeviceModel, conn redis.Conn) {
+
+	request := &models.ApproveRequest{}
+
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+			WriteServerErrorResponse("Unable to parse body", http.StatusBadRequest, w)
+			return
+		}
+	}
+
+	request.DeviceID = params["id"]
+
+	thing, err := deviceModel.Approve(request, conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown pending device id: %s", params["id"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to approve device", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(thing, http.StatusOK, w)
+}
+
+// PostReject discards a pending device, and ignores any future announcements from it
+func (lr *DeviceRouter) PostReject(params martini.Params, w http.ResponseWriter, deviceModel *models.DeviceModel, conn redis.Conn) {
+
+	err := deviceModel.Reject(params["id"], conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown pending device id: %s", params["id"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to reject device", http.StatusInternalServerError, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteBlacklisted allows a previously rejected device to be announced again
+func (lr *DeviceRouter) DeleteBlacklisted(params martini.Params, w http.ResponseWriter, deviceModel *models.DeviceModel, conn redis.Conn) {
+
+	err := deviceModel.Unblacklist(params["naturalId"], conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown blacklisted natural id: %s", params["naturalId"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to remove device from blacklist", http.StatusInternalServerError, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,229 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-martini/martini"
+	"github.com/ninjasphere/redigo/redis"
+	"github.com/ninjasphere/sphere-go-homecloud/models"
+)
+
+type FloorRouter struct {
+}
+
+func NewFloorRouter() *FloorRouter {
+	return &FloorRouter{}
+}
+
+func (lr *FloorRouter) Register(r martini.Router) {
+
+	r.Get("", lr.GetAll)
+	r.Post("", lr.PostNewFloor)
+	r.Get("/:id", lr.GetFloor)
+	r.Put("/:id", lr.UpdateFloor)
+	r.Delete("/:id", lr.DeleteFloor)
+	r.Get("/:id/rooms", lr.GetRooms)
+	r.Put("/:id/rooms", lr.PutRooms)
+	r.Post("/:id/channels/:channel", lr.PostChannelActuation)
+
+}
+
+// GetAll retrieves a list of floors, in order
+//
+// Response
+// [
+//    {
+//       "id" : "0b5fa8e1-7bd4-4f27-a0a0-4b0bd7c8e5b6",
+//       "siteId" : "a5a15a3e-7a1c-4b4e-a6ba-1e5b3d3c3b2a",
+//       "name" : "Ground floor",
+//       "type" : "floor",
+//       "order" : 0,
+//       "rooms" : ["1468fbcd-3ca6-4c6f-a742-ab91221e5462"]
+//    }
+// ]
+//
+func (lr *FloorRouter) GetAll(w http.ResponseWriter, floorModel *models.FloorModel, conn redis.Conn) {
+	floors, err := floorModel.FetchAll(conn)
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve floors", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(floors, http.StatusOK, w)
+}
+
+// PostNewFloor creates a new floor or area
+//
+// Request {"name":"Ground floor","type":"floor","order":0,"rooms":["1468fbcd-3ca6-4c6f-a742-ab91221e5462"]}
+// Response the created floor
+//
+func (lr *FloorRouter) PostNewFloor(r *http.Request, w http.ResponseWriter, floorModel *models.FloorModel, conn redis.Conn) {
+
+	floor := &models.Floor{}
+
+	if err := json.NewDecoder(r.Body).Decode(floor); err != nil || floor.Name == "" {
+		WriteServerErrorResponse("Unable to parse body, name is required", http.StatusBadRequest, w)
+		return
+	}
+
+	rooms := floor.Rooms
+	floor.ID = ""
+	floor.Rooms = nil
+
+	if err := floorModel.Create(floor, conn); err != nil {
+		WriteServerErrorResponse("Unable to create floor", http.StatusInternalServerError, w)
+		return
+	}
+
+	if len(rooms) > 0 {
+		if err := floorModel.SetRooms(floor.ID, rooms, conn); err != nil {
+			WriteServerErrorResponse(fmt.Sprintf("Unable to assign rooms to floor: %s", err), http.StatusBadRequest, w)
+			return
+		}
+		floor.Rooms = rooms
+	}
+
+	WriteServerResponse(floor, http.StatusOK, w)
+}
+
+// GetFloor retrieves a floor using it's identifier
+func (lr *FloorRouter) GetFloor(params martini.Params, w http.ResponseWriter, floorModel *models.FloorModel, conn redis.Conn) {
+
+	floor, err := floorModel.Fetch(params["id"], conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown floor id: %s", params["id"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve floor", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(floor, http.StatusOK, w)
+}
+
+// UpdateFloor updates the name, type and order of a floor
+func (lr *FloorRouter) UpdateFloor(params martini.Params, r *http.Request, w http.ResponseWriter, floorModel *models.FloorModel, conn redis.Conn) {
+
+	floor := &models.Floor{}
+
+	if err := json.NewDecoder(r.Body).Decode(floor); err != nil {
+		WriteServerErrorResponse("Unable to parse body", http.StatusBadRequest, w)
+		return
+	}
+
+	err := floorModel.Update(params["id"], floor, conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown floor id: %s", params["id"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to update floor", http.StatusInternalServerError, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteFloor removes a floor using it's identifier. The rooms on it are not affected.
+func (lr *FloorRouter) DeleteFloor(params martini.Params, w http.ResponseWriter, floorModel *models.FloorModel, conn redis.Conn) {
+
+	err := floorModel.Delete(params["id"], conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown floor id: %s", params["id"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to delete floor", http.StatusInternalServerError, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetRooms retrieves the rooms on a floor, in order
+func (lr *FloorRouter) GetRooms(params martini.Params, w http.ResponseWriter, floorModel *models.FloorModel, conn redis.Conn) {
+
+	rooms, err := floorModel.FetchRooms(params["id"], conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown floor id: %s", params["id"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve rooms", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(rooms, http.StatusOK, w)
+}
+
+// PutRooms sets the rooms on a floor, in the order they should be shown
+//
+// Request ["1468fbcd-3ca6-4c6f-a742-ab91221e5462","16c63268-c0e5-48a2-b312-c74c64837802"]
+// Response 200
+//
+func (lr *FloorRouter) PutRooms(params martini.Params, r *http.Request, w http.ResponseWriter, floorModel *models.FloorModel, conn redis.Conn) {
+
+	var rooms []string
+
+	if err := json.NewDecoder(r.Body).Decode(&rooms); err != nil {
+		WriteServerErrorResponse("Unable to parse body", http.StatusBadRequest, w)
+		return
+	}
+
+	err := floorModel.SetRooms(params["id"], rooms, conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown floor id: %s", params["id"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse(fmt.Sprintf("Unable to assign rooms to floor: %s", err), http.StatusBadRequest, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// PostChannelActuation calls a method on a channel protocol, on every thing in every room on the floor
+//
+// Request {"method":"turnOff"}
+// Response the replies from each thing, keyed by thing id
+//
+func (lr *FloorRouter) PostChannelActuation(params martini.Params, r *http.Request, w http.ResponseWriter, floorModel *models.FloorModel, conn redis.Conn) {
+
+	request := &actuationRequest{}
+
+	err := json.NewDecoder(r.Body).Decode(request)
+
+	if err != nil || request.Method == "" {
+		WriteServerErrorResponse("Unable to parse body, method is required", http.StatusBadRequest, w)
+		return
+	}
+
+	results, err := floorModel.Actuate(params["id"], params["channel"], request.Method, request.Params, conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown floor id: %s", params["id"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to actuate floor", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(results, http.StatusOK, w)
+}
@@ -2,10 +2,15 @@ package rest
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/go-martini/martini"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/schemas"
+	"github.com/ninjasphere/redigo/redis"
+	"github.com/ninjasphere/sphere-go-homecloud/location"
 	"github.com/ninjasphere/sphere-go-homecloud/models"
 )
 
@@ -26,27 +31,20 @@ func (lr *LocationRouter) Register(r martini.Router) {
 
 }
 
-// GetCalibrateScores This retrieves the calibration scores for a room
+// GetCalibrateScores This retrieves the calibration scores for each room
 //
-// NOTE: Currently returns 504 Gateway Time-out on my sphere
+// Response {"type":"simple_calibration_scores","data":{"1468fbcd-3ca6-4c6f-a742-ab91221e5462":0.92}}
 //
-func (lr *LocationRouter) GetCalibrateScores(r *http.Request, w http.ResponseWriter) {
-
-	// req.bus.callMethod('$ninja/services/rpc/' + rpcMethod.replace('.', '/'), rpcMethod, args, function(err, result) {
-	//   if (err) {
-	//     return res.json(500, {
-	//       type: 'error',
-	//       error: { code: 500, type: 'internal_error', message: 'An internal server error occured.'}
-	//     });
-	//   } else {
-	//     return res.json({
-	//       type: 'simple_calibration_scores',
-	//       data: result || {}
-	//     });
-	//   }
-	// });
-
-	resp := &ResponseWrapper{Type: "simple_calibration_scores", Data: struct{}{}}
+func (lr *LocationRouter) GetCalibrateScores(r *http.Request, w http.ResponseWriter, locationManager location.LocationManager) {
+
+	scores, err := locationManager.GetCalibrationScores()
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve calibration scores", http.StatusInternalServerError, w)
+		return
+	}
+
+	resp := &ResponseWrapper{Type: "simple_calibration_scores", Data: scores}
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Errorf("Unable to serialise response: %s", err)
@@ -54,16 +52,45 @@ func (lr *LocationRouter) GetCalibrateScores(r *http.Request, w http.ResponseWri
 
 }
 
-// GetCalibrateDevice
+// GetCalibrateDevice returns the device with the strongest signal, which is the one being held up to the sphere
 //
 // NOTE: This currently gets hit a ton by the web ui when you click the Calibrate button on the site.
 //
-func (lr *LocationRouter) GetCalibrateDevice(r *http.Request, w http.ResponseWriter) {
-	w.WriteHeader(http.StatusOK) // TODO: work out how this will be done.
+// Response {"device":"F0E4FFFFFFFF","name":"Bob's Tag","rssi":-42,"seen":"2015-01-05T10:01:17.041Z"}
+//
+func (lr *LocationRouter) GetCalibrateDevice(r *http.Request, w http.ResponseWriter, locationManager location.LocationManager) {
+
+	device, err := locationManager.GetCalibrationDevice()
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve calibration device", http.StatusInternalServerError, w)
+		return
+	}
+
+	if device == nil {
+		WriteServerErrorResponse("No device is currently visible", http.StatusNotFound, w)
+		return
+	}
+
+	WriteServerResponse(device, http.StatusOK, w)
 }
 
-func (lr *LocationRouter) GetCalibrationProgress(r *http.Request, w http.ResponseWriter) {
-	w.WriteHeader(http.StatusOK) // TODO: work out how this will be done.
+// GetCalibrationProgress returns the state of the current (or last) calibration
+//
+// Response {"state":"calibrating","zone":"1468fbcd-3ca6-4c6f-a742-ab91221e5462","device":"F0E4FFFFFFFF","progress":0.5}
+//
+// A calibration that stops reporting progress times out, and is idle again with an "error".
+//
+func (lr *LocationRouter) GetCalibrationProgress(r *http.Request, w http.ResponseWriter, locationManager location.LocationManager) {
+
+	status, err := locationManager.GetCalibrationProgress()
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve calibration progress", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(status, http.StatusOK, w)
 }
 
 // PostCreateThing this will create a device and a thing from bluetooth devices discovered.
@@ -72,20 +99,143 @@ func (lr *LocationRouter) GetCalibrationProgress(r *http.Request, w http.Respons
 //
 // Responds with {"success":true,"id":"7efa45b0-2108-464d-83c6-8af1785bc9ea"}
 //
-func (lr *LocationRouter) PostCreateThing(r *http.Request, w http.ResponseWriter, thingModel *models.ThingModel, deviceModel *models.DeviceModel) {
+func (lr *LocationRouter) PostCreateThing(r *http.Request, w http.ResponseWriter, thingModel *models.ThingModel, deviceModel *models.DeviceModel, conn redis.Conn) {
+
+	var request struct {
+		DeviceID  string `json:"deviceId"`
+		ThingName string `json:"thingName"`
+		ThingType string `json:"thingType"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		WriteServerErrorResponse("Unable to parse body", http.StatusBadRequest, w)
+		return
+	}
 
-	// get the request body
-	body, err := GetJsonPayload(r)
+	log.Infof(spew.Sprintf("posted body : %v", request))
+
+	if request.DeviceID == "" || request.ThingName == "" || request.ThingType == "" {
+		WriteServerErrorResponse("deviceId, thingName and thingType are required", http.StatusBadRequest, w)
+		return
+	}
+
+	thing := &model.Thing{
+		DeviceID: &request.DeviceID,
+		Name:     request.ThingName,
+		Type:     request.ThingType,
+	}
+
+	if problem, err := schemas.Validate("/model/thing", thing); err != nil {
+		log.Warningf("Could not validate thing type %s, accepting it anyway. error: %s", request.ThingType, err)
+	} else if problem != nil {
+		WriteServerErrorResponse(fmt.Sprintf("Invalid thing type %s: %s", request.ThingType, *problem), http.StatusBadRequest, w)
+		return
+	}
+
+	existing, err := thingModel.FetchByDeviceId(request.DeviceID, conn)
+
+	if err != nil && err != models.RecordNotFound {
+		WriteServerErrorResponse("Unable to check for an existing thing", http.StatusInternalServerError, w)
+		return
+	}
+
+	if existing != nil {
+		WriteServerErrorResponse(fmt.Sprintf("Device %s already has a thing: %s", request.DeviceID, existing.ID), http.StatusConflict, w)
+		return
+	}
+
+	blacklisted, err := deviceModel.IsBlacklistedDevice(request.DeviceID, conn)
+
+	if err == nil && !blacklisted {
+		// A bluetooth device we'd create is blacklisted by its id as the natural id
+		blacklisted, err = deviceModel.IsBlacklisted(request.DeviceID, conn)
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to check device blacklist", http.StatusInternalServerError, w)
+		return
+	}
+
+	if blacklisted {
+		WriteServerErrorResponse(fmt.Sprintf("Device %s has been rejected", request.DeviceID), http.StatusConflict, w)
+		return
+	}
+
+	pending, err := deviceModel.IsPending(request.DeviceID, conn)
 
 	if err != nil {
-		WriteServerErrorResponse("Unable to parse body", http.StatusInternalServerError, w)
+		WriteServerErrorResponse("Unable to check for a pending device", http.StatusInternalServerError, w)
 		return
 	}
 
-	log.Infof(spew.Sprintf("posted body : %v", body))
+	exists, err := deviceModel.Exists(request.DeviceID, conn)
 
-	//	deviceID := body["deviceId"].(string)
+	if err != nil {
+		WriteServerErrorResponse("Unable to check for an existing device", http.StatusInternalServerError, w)
+		return
+	}
 
-	w.WriteHeader(http.StatusOK) // TODO: work out how this will be done.
+	if pending {
+		// The device has been announced and is waiting for approval, which this is
+		_, err = deviceModel.Approve(&models.ApproveRequest{
+			DeviceID: request.DeviceID,
+			Name:     request.ThingName,
+			Type:     request.ThingType,
+		}, conn)
+	} else if exists {
+		// The device has been seen before, but has no thing
+		err = thingModel.Create(thing, conn)
+	} else {
+		err = createBluetoothDevice(request.DeviceID, request.ThingName, request.ThingType, deviceModel, conn)
+	}
+
+	if err != nil {
+		log.Errorf("Failed to create thing for device %s: %s", request.DeviceID, err)
+		WriteServerErrorResponse("Unable to create thing", http.StatusInternalServerError, w)
+		return
+	}
+
+	created, err := thingModel.FetchByDeviceId(request.DeviceID, conn)
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve created thing", http.StatusInternalServerError, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": created.ID}); err != nil {
+		log.Errorf("Unable to serialise response: %s", err)
+	}
+}
+
+// createBluetoothDevice saves a new device, which in turn creates its thing. The name and
+// type of the thing are passed through the device's name and signatures.
+func createBluetoothDevice(deviceID, thingName, thingType string, deviceModel *models.DeviceModel, conn redis.Conn) error {
+
+	device := &model.Device{
+		ID:            deviceID,
+		NaturalID:     deviceID,
+		NaturalIDType: "ble",
+		Name:          &thingName,
+		Signatures: &map[string]string{
+			"ninja:thingType": thingType,
+		},
+	}
+
+	if err := deviceModel.Create(device, conn); err != nil {
+		return err
+	}
+
+	// In approval mode the device is now waiting in the pending inbox, but creating it
+	// here is approval enough.
+	if _, err := deviceModel.FetchPending(deviceID, conn); err == nil {
+		_, err = deviceModel.Approve(&models.ApproveRequest{
+			DeviceID: deviceID,
+			Name:     thingName,
+			Type:     thingType,
+		}, conn)
+		return err
+	}
 
+	return nil
 }
@@ -0,0 +1,27 @@
+package rest
+
+import (
+	"net/http"
+
+	"github.com/go-martini/martini"
+	"github.com/ninjasphere/sphere-go-homecloud/presence"
+)
+
+type OccupancyRouter struct {
+}
+
+func NewOccupancyRouter() *OccupancyRouter {
+	return &OccupancyRouter{}
+}
+
+func (lr *OccupancyRouter) Register(r martini.Router) {
+
+	r.Get("", lr.GetAll)
+
+}
+
+// GetAll retrieves who is in each room. Occupancy is only kept in memory, so it starts empty
+// again whenever homecloud restarts, and fills in as location updates arrive.
+func (lr *OccupancyRouter) GetAll(w http.ResponseWriter, presenceManager *presence.PresenceManager) {
+	WriteServerResponse(presenceManager.GetAllOccupancy(), http.StatusOK, w)
+}
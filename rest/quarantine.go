@@ -0,0 +1,106 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-martini/martini"
+	"github.com/ninjasphere/redigo/redis"
+	"github.com/ninjasphere/sphere-go-homecloud/models"
+)
+
+type QuarantineRouter struct {
+}
+
+func NewQuarantineRouter() *QuarantineRouter {
+	return &QuarantineRouter{}
+}
+
+func (lr *QuarantineRouter) Register(r martini.Router) {
+
+	r.Get("", lr.GetAll)
+	r.Get("/:id", lr.GetQuarantined)
+	r.Post("/:id/retry", lr.PostRetry)
+	r.Delete("/:id", lr.DeleteQuarantined)
+
+}
+
+// GetAll retrieves all the device and channel announcements that failed validation
+//
+// Response
+// [
+//    {
+//       "id" : "channel:2864dd823a+light",
+//       "type" : "channel",
+//       "deviceId" : "2864dd823a",
+//       "channelId" : "light",
+//       "payload" : {"id":"light","protocol":"light"},
+//       "error" : "Announcement does not match schema /model/channel: ...",
+//       "received" : "2015-01-05T10:01:17.041Z"
+//    }
+// ]
+//
+func (lr *QuarantineRouter) GetAll(w http.ResponseWriter, quarantineModel *models.QuarantineModel, conn redis.Conn) {
+	items, err := quarantineModel.FetchAll(conn)
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve quarantined announcements", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(items, http.StatusOK, w)
+}
+
+// GetQuarantined retrieves a quarantined announcement using it's identifier
+func (lr *QuarantineRouter) GetQuarantined(params martini.Params, w http.ResponseWriter, quarantineModel *models.QuarantineModel, conn redis.Conn) {
+
+	item, err := quarantineModel.Fetch(params["id"], conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown quarantined announcement id: %s", params["id"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve quarantined announcement", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(item, http.StatusOK, w)
+}
+
+// PostRetry processes a quarantined announcement again. If it is still invalid it stays in quarantine.
+func (lr *QuarantineRouter) PostRetry(params martini.Params, w http.ResponseWriter, quarantineModel *models.QuarantineModel, conn redis.Conn) {
+
+	err := quarantineModel.Retry(params["id"], conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown quarantined announcement id: %s", params["id"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse(fmt.Sprintf("Unable to process announcement: %s", err), http.StatusBadRequest, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteQuarantined discards a quarantined announcement
+func (lr *QuarantineRouter) DeleteQuarantined(params martini.Params, w http.ResponseWriter, quarantineModel *models.QuarantineModel, conn redis.Conn) {
+
+	err := quarantineModel.Discard(params["id"], conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown quarantined announcement id: %s", params["id"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to discard quarantined announcement", http.StatusInternalServerError, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -1,6 +1,7 @@
 package rest
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -9,7 +10,9 @@ import (
 	"github.com/ninjasphere/go-ninja/api"
 	"github.com/ninjasphere/go-ninja/model"
 	"github.com/ninjasphere/redigo/redis"
+	"github.com/ninjasphere/sphere-go-homecloud/location"
 	"github.com/ninjasphere/sphere-go-homecloud/models"
+	"github.com/ninjasphere/sphere-go-homecloud/presence"
 )
 
 type RoomRouter struct {
@@ -29,6 +32,8 @@ func (lr *RoomRouter) Register(r martini.Router) {
 	// r.Get("/:id/things", lr.GetThings) Not sure if this was used
 	r.Put("/:id/calibrate", lr.PutCalibrateRoom)
 	r.Put("/:id/apps/:appName", lr.PutAppRoomMessage)
+	r.Post("/:id/channels/:channel", lr.PostChannelActuation)
+	r.Get("/:id/occupancy", lr.GetOccupancy)
 
 }
 
@@ -167,22 +172,37 @@ func (lr *RoomRouter) UpdateRoom(params martini.Params, r *http.Request, w http.
 	WriteServerResponse(room, http.StatusOK, w)
 }
 
-// DeleteRoom removes a room using it's identifier
-func (lr *RoomRouter) DeleteRoom(params martini.Params, w http.ResponseWriter, roomModel *models.RoomModel, conn redis.Conn) {
+// DeleteRoom removes a room using it's identifier. The policy says what happens to the things in the room,
+// "unassign" (the default), "move" (to the room given by roomId) or "default" (to the site's default room).
+//
+// Request DELETE /rest/v1/rooms/1468fbcd-3ca6-4c6f-a742-ab91221e5462?policy=move&roomId=16c63268-c0e5-48a2-b312-c74c64837802
+// Response {"id":"1468fbcd-3ca6-4c6f-a742-ab91221e5462","policy":"move","roomId":"16c63268-c0e5-48a2-b312-c74c64837802","things":[{"thingId":"4b518a5d-f855-4e21-86e0-6e91f6772bea","name":"Hue Lamp 2","action":"moved","roomId":"16c63268-c0e5-48a2-b312-c74c64837802","unpromoted":false}]}
+//
+func (lr *RoomRouter) DeleteRoom(params martini.Params, r *http.Request, w http.ResponseWriter, roomModel *models.RoomModel, conn redis.Conn) {
+
+	policy := &models.RoomDeletePolicy{
+		Policy: r.URL.Query().Get("policy"),
+		RoomID: r.URL.Query().Get("roomId"),
+	}
 
-	err := roomModel.Delete(params["id"], conn)
+	deletion, err := roomModel.DeleteWithPolicy(params["id"], policy, conn)
 
 	if err == models.RecordNotFound {
 		WriteServerErrorResponse(fmt.Sprintf("Unknown room id: %s", params["id"]), http.StatusNotFound, w)
 		return
 	}
 
+	if err == models.InvalidRoomDeletePolicy {
+		WriteServerErrorResponse("Invalid policy, must be unassign, default or move with a roomId of another existing room", http.StatusBadRequest, w)
+		return
+	}
+
 	if err != nil {
 		WriteServerErrorResponse("Unable to delete room", http.StatusInternalServerError, w)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK) // TODO: talk to theo about this response.
+	WriteServerResponse(deletion, http.StatusOK, w)
 }
 
 // PutCalibrateRoom enables calibration for a specific room
@@ -190,7 +210,7 @@ func (lr *RoomRouter) DeleteRoom(params martini.Params, w http.ResponseWriter, r
 // Request {"id":"1468fbcd-3ca6-4c6f-a742-ab91221e5462","device":"20CD39A0899C","reset":true}
 // Response 200
 //
-func (lr *RoomRouter) PutCalibrateRoom(params martini.Params, w http.ResponseWriter, roomModel *models.RoomModel, conn redis.Conn) {
+func (lr *RoomRouter) PutCalibrateRoom(params martini.Params, r *http.Request, w http.ResponseWriter, roomModel *models.RoomModel, locationManager location.LocationManager, conn redis.Conn) {
 
 	room, err := roomModel.Fetch(params["id"], conn)
 
@@ -206,8 +226,20 @@ func (lr *RoomRouter) PutCalibrateRoom(params martini.Params, w http.ResponseWri
 		return
 	}
 
-	// TODO: Need to send message over an RPC thing
-	// LocationManager.calibrate(req.params.id, req.body.device, req.body.reset||false, function(err) {
+	var request struct {
+		Device string `json:"device"`
+		Reset  bool   `json:"reset"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Device == "" {
+		WriteServerErrorResponse("Unable to parse body, device is required", http.StatusBadRequest, w)
+		return
+	}
+
+	if err := locationManager.Calibrate(room.ID, request.Device, request.Reset); err != nil {
+		WriteServerErrorResponse("Unable to start calibration", http.StatusInternalServerError, w)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -252,3 +284,68 @@ func (lr *RoomRouter) PutAppRoomMessage(params martini.Params, r *http.Request,
 
 	w.WriteHeader(http.StatusOK)
 }
+
+type actuationRequest struct {
+	Method string           `json:"method"`
+	Params *json.RawMessage `json:"params,omitempty"`
+}
+
+// PostChannelActuation calls a method on a channel protocol, on every thing in the room that has it
+//
+// Request {"method":"turnOff"}
+// Response
+// {
+//    "4b518a5d-f855-4e21-86e0-6e91f6772bea" : {
+//       "thingId" : "4b518a5d-f855-4e21-86e0-6e91f6772bea",
+//       "deviceId" : "2864dd823a",
+//       "channelId" : "on-off",
+//       "reply" : null
+//    }
+// }
+//
+func (lr *RoomRouter) PostChannelActuation(params martini.Params, r *http.Request, w http.ResponseWriter, roomModel *models.RoomModel, conn redis.Conn) {
+
+	request := &actuationRequest{}
+
+	err := json.NewDecoder(r.Body).Decode(request)
+
+	if err != nil || request.Method == "" {
+		WriteServerErrorResponse("Unable to parse body, method is required", http.StatusBadRequest, w)
+		return
+	}
+
+	results, err := roomModel.Actuate(params["id"], params["channel"], request.Method, request.Params, conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown room id: %s", params["id"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to actuate room", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(results, http.StatusOK, w)
+}
+
+// GetOccupancy retrieves who is in a room, and since when
+//
+// Response {"roomId":"1468fbcd-3ca6-4c6f-a742-ab91221e5462","occupants":[{"thingId":"7efa45b0-2108-464d-83c6-8af1785bc9ea","name":"Bob","since":"2015-01-05T10:01:17.041Z"}]}
+//
+func (lr *RoomRouter) GetOccupancy(params martini.Params, w http.ResponseWriter, roomModel *models.RoomModel, presenceManager *presence.PresenceManager, conn redis.Conn) {
+
+	_, err := roomModel.Fetch(params["id"], conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown room id: %s", params["id"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve room", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(presenceManager.GetOccupancy(params["id"]), http.StatusOK, w)
+}
@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/go-martini/martini"
 	"github.com/ninjasphere/go-ninja/model"
 	"github.com/ninjasphere/redigo/redis"
 	"github.com/ninjasphere/sphere-go-homecloud/models"
+	"github.com/ninjasphere/sphere-go-homecloud/solar"
 	"github.com/ninjasphere/sphere-go-homecloud/state"
 )
 
@@ -26,6 +28,7 @@ func (lr *SiteRouter) Register(r martini.Router) {
 	r.Get("/:id", lr.GetSite)
 	r.Put("/:id", lr.PutSite)
 	r.Delete("/:id", lr.DeleteSite)
+	r.Get("/:id/solar", lr.GetSolar)
 
 }
 
@@ -100,3 +103,47 @@ func (lr *SiteRouter) DeleteSite(params martini.Params, w http.ResponseWriter, s
 
 	w.WriteHeader(http.StatusOK) // TODO: talk to theo about this response.
 }
+
+// GetSolar calculates the sunrise, sunset, civil dawn and dusk and solar noon at a site, for today
+// or the date given in the "date" query param (i.e. ?date=2015-01-05)
+//
+// Response {"date":"2015-01-05","civilDawn":"2015-01-05T05:21:25+11:00","sunrise":"2015-01-05T05:50:17+11:00",...}
+//
+func (lr *SiteRouter) GetSolar(params martini.Params, r *http.Request, w http.ResponseWriter, siteModel *models.SiteModel, conn redis.Conn) {
+
+	site, err := siteModel.Fetch(params["id"], conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown site id: %s", params["id"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve site", http.StatusInternalServerError, w)
+		return
+	}
+
+	if site.Latitude == nil || site.Longitude == nil {
+		WriteServerErrorResponse("The site has no location", http.StatusBadRequest, w)
+		return
+	}
+
+	location, err := solar.SiteLocation(site)
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to load the site's timezone", http.StatusInternalServerError, w)
+		return
+	}
+
+	date := time.Now().In(location)
+
+	if qs := r.URL.Query().Get("date"); qs != "" {
+		date, err = time.ParseInLocation("2006-01-02", qs, location)
+		if err != nil {
+			WriteServerErrorResponse("date must be in the format YYYY-MM-DD", http.StatusBadRequest, w)
+			return
+		}
+	}
+
+	WriteServerResponse(solar.Calculate(date, *site.Latitude, *site.Longitude), http.StatusOK, w)
+}
@@ -0,0 +1,371 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-martini/martini"
+	"github.com/ninjasphere/redigo/redis"
+	"github.com/ninjasphere/sphere-go-homecloud/models"
+)
+
+type SyncRouter struct {
+}
+
+func NewSyncRouter() *SyncRouter {
+	return &SyncRouter{}
+}
+
+func (lr *SyncRouter) Register(r martini.Router) {
+
+	r.Get("", lr.GetStatus)
+	r.Post("", lr.PostSyncNow)
+	r.Get("/preview", lr.GetPreview)
+	r.Get("/conflicts", lr.GetConflicts)
+	r.Delete("/conflicts", lr.DeleteConflicts)
+	r.Get("/journal/:model", lr.GetJournal)
+	r.Get("/exclusions", lr.GetExclusions)
+	r.Put("/exclusions/types/:type", lr.PutExcludedType)
+	r.Delete("/exclusions/types/:type", lr.DeleteExcludedType)
+	r.Get("/exclusions/:model/:id", lr.GetExclusion)
+	r.Put("/exclusions/:model/:id", lr.PutExclusion)
+	r.Delete("/exclusions/:model/:id", lr.DeleteExclusion)
+	r.Put("/modules/:id/secret", lr.PutModuleSecret)
+	r.Delete("/modules/:id/secret", lr.DeleteModuleSecret)
+
+}
+
+// GetStatus retrieves how syncing with the cloud is going, for each model
+//
+// Response
+// {
+//    "thing" : {
+//       "model" : "thing",
+//       "inSync" : false,
+//       "lastAttempt" : "2015-01-05T10:01:17.041Z",
+//       "lastSuccess" : "2015-01-05T09:01:15.312Z",
+//       "lastError" : "Failed calling calculate_sync_items for model thing error:timeout",
+//       "lastErrorAt" : "2015-01-05T10:01:37.044Z",
+//       "lastRun" : "changes",
+//       "pushed" : 2,
+//       "pulled" : 0,
+//       "pending" : 1
+//    }
+// }
+//
+func (lr *SyncRouter) GetStatus(w http.ResponseWriter, syncMonitor *models.SyncMonitor, conn redis.Conn) {
+
+	statuses, err := syncMonitor.FetchAllStatus(conn)
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve sync status", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(statuses, http.StatusOK, w)
+}
+
+// PostSyncNow syncs every model with the cloud straight away, even if syncing has been backing off
+// because the cloud was unreachable. The sync happens in the background, poll GetStatus for the result.
+//
+// Response 202
+//
+func (lr *SyncRouter) PostSyncNow(w http.ResponseWriter, syncMonitor *models.SyncMonitor) {
+
+	if err := syncMonitor.SyncNow(); err != nil {
+		WriteServerErrorResponse(err.Error(), http.StatusServiceUnavailable, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// GetPreview reports what syncing would do, without doing it. It can be limited to one model, and
+// show what would happen if syncing from the cloud, or deleting unknown objects from it, were enabled.
+//
+// Request GET /rest/v1/sync/preview?model=thing&fromCloud=true
+// Response
+// {
+//    "thing" : {
+//       "model" : "thing",
+//       "fromCloud" : true,
+//       "deleteUnknownFromCloud" : false,
+//       "items" : [
+//          {
+//             "id" : "4b518a5d-f855-4e21-86e0-6e91f6772bea",
+//             "action" : "overwrite",
+//             "before" : {"id":"4b518a5d-f855-4e21-86e0-6e91f6772bea","name":"Kitchen Lamp","type":"light"},
+//             "after" : {"id":"4b518a5d-f855-4e21-86e0-6e91f6772bea","name":"Hue Lamp 2","type":"light"},
+//             "changes" : {"name":{"before":"Kitchen Lamp","after":"Hue Lamp 2"}}
+//          }
+//       ]
+//    }
+// }
+//
+func (lr *SyncRouter) GetPreview(r *http.Request, w http.ResponseWriter, syncMonitor *models.SyncMonitor, conn redis.Conn) {
+
+	options := &models.SyncPreviewOptions{}
+
+	for name, option := range map[string]**bool{"fromCloud": &options.FromCloud, "deleteUnknownFromCloud": &options.DeleteUnknownFromCloud} {
+		if value := r.URL.Query().Get(name); value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				WriteServerErrorResponse(fmt.Sprintf("Invalid %s", name), http.StatusBadRequest, w)
+				return
+			}
+			*option = &b
+		}
+	}
+
+	model := r.URL.Query().Get("model")
+
+	previews, err := syncMonitor.PreviewSync(model, options, conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown model: %s", model), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse(fmt.Sprintf("Unable to preview sync: %s", err), http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(previews, http.StatusOK, w)
+}
+
+// GetConflicts retrieves the most recent sync conflicts and how they were resolved, newest first.
+// They can be filtered by model, and limited in number.
+//
+// Request GET /rest/v1/sync/conflicts?model=thing&limit=10
+// Response
+// [
+//    {
+//       "id" : "9f4b6f47-4a3c-4a57-8c3b-5bb1b1a5a0c1",
+//       "model" : "thing",
+//       "objectId" : "4b518a5d-f855-4e21-86e0-6e91f6772bea",
+//       "policy" : "merge",
+//       "resolution" : "merged",
+//       "fields" : ["name"],
+//       "local" : {"id":"4b518a5d-f855-4e21-86e0-6e91f6772bea","name":"Kitchen Lamp","type":"light"},
+//       "cloud" : {"id":"4b518a5d-f855-4e21-86e0-6e91f6772bea","name":"Hue Lamp 2","type":"lamp"},
+//       "base" : {"id":"4b518a5d-f855-4e21-86e0-6e91f6772bea","name":"Hue Lamp","type":"light"},
+//       "result" : {"id":"4b518a5d-f855-4e21-86e0-6e91f6772bea","name":"Kitchen Lamp","type":"lamp"},
+//       "localModified" : 1420452077041,
+//       "cloudModified" : 1420450011523,
+//       "time" : "2015-01-05T10:01:17.041Z"
+//    }
+// ]
+//
+func (lr *SyncRouter) GetConflicts(r *http.Request, w http.ResponseWriter, conflictLog *models.ConflictLog, conn redis.Conn) {
+
+	limit := 0
+
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			WriteServerErrorResponse("Invalid limit", http.StatusBadRequest, w)
+			return
+		}
+	}
+
+	conflicts, err := conflictLog.FetchAll(r.URL.Query().Get("model"), limit, conn)
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve sync conflicts", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(conflicts, http.StatusOK, w)
+}
+
+// DeleteConflicts clears the conflict log
+func (lr *SyncRouter) DeleteConflicts(w http.ResponseWriter, conflictLog *models.ConflictLog, conn redis.Conn) {
+
+	if err := conflictLog.Clear(conn); err != nil {
+		WriteServerErrorResponse("Unable to clear sync conflicts", http.StatusInternalServerError, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetJournal retrieves the changes made to a model, oldest first, as an audit trail. Changes the
+// cloud has acknowledged are compacted away over time. It can be limited to changes after a
+// sequence number, and in number.
+//
+// Request GET /rest/v1/sync/journal/thing?since=41&limit=100
+// Response
+// {
+//    "model" : "thing",
+//    "head" : 43,
+//    "acknowledged" : 42,
+//    "entries" : [
+//       {
+//          "seq" : 42,
+//          "id" : "4b518a5d-f855-4e21-86e0-6e91f6772bea",
+//          "op" : "update",
+//          "time" : "2015-01-05T10:01:17.041Z",
+//          "hash" : "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12",
+//          "data" : {"id":"4b518a5d-f855-4e21-86e0-6e91f6772bea","name":"Kitchen Lamp","type":"light"},
+//          "source" : "local",
+//          "acknowledged" : true
+//       },
+//       {
+//          "seq" : 43,
+//          "id" : "4b518a5d-f855-4e21-86e0-6e91f6772bea",
+//          "op" : "delete",
+//          "time" : "2015-01-05T10:02:03.512Z",
+//          "source" : "local",
+//          "acknowledged" : false
+//       }
+//    ]
+// }
+//
+func (lr *SyncRouter) GetJournal(params martini.Params, r *http.Request, w http.ResponseWriter, syncMonitor *models.SyncMonitor, conn redis.Conn) {
+
+	var since int64
+	limit := 0
+
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseInt(s, 10, 64); err != nil {
+			WriteServerErrorResponse("Invalid since", http.StatusBadRequest, w)
+			return
+		}
+	}
+
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			WriteServerErrorResponse("Invalid limit", http.StatusBadRequest, w)
+			return
+		}
+	}
+
+	journal, err := syncMonitor.FetchJournal(params["model"], since, limit, conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown model: %s", params["model"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve change journal", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(journal, http.StatusOK, w)
+}
+
+// GetExclusions retrieves the things, devices, rooms and thing types that are kept out of the cloud
+//
+// Response {"things":["4b518a5d-f855-4e21-86e0-6e91f6772bea"],"devices":[],"rooms":[],"types":["camera"]}
+//
+func (lr *SyncRouter) GetExclusions(w http.ResponseWriter, syncExclusions *models.SyncExclusions, conn redis.Conn) {
+
+	list, err := syncExclusions.FetchAll(conn)
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve sync exclusions", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(list, http.StatusOK, w)
+}
+
+// GetExclusion says whether a thing, device, channel or room is kept out of the cloud, either
+// directly or because of what it belongs to
+//
+// Request GET /rest/v1/sync/exclusions/channel/2864dd823a-light
+// Response {"model":"channel","id":"2864dd823a-light","excluded":true}
+//
+func (lr *SyncRouter) GetExclusion(params martini.Params, w http.ResponseWriter, syncExclusions *models.SyncExclusions, conn redis.Conn) {
+
+	excluded, err := syncExclusions.IsExcluded(params["model"], params["id"], conn)
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to check sync exclusion", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(map[string]interface{}{
+		"model":    params["model"],
+		"id":       params["id"],
+		"excluded": excluded,
+	}, http.StatusOK, w)
+}
+
+// PutExclusion keeps a thing, device or room (and everything belonging to it) out of the cloud
+//
+// Request PUT /rest/v1/sync/exclusions/thing/4b518a5d-f855-4e21-86e0-6e91f6772bea
+// Response 200
+//
+func (lr *SyncRouter) PutExclusion(params martini.Params, w http.ResponseWriter, syncExclusions *models.SyncExclusions, conn redis.Conn) {
+	lr.writeExclusionResult(syncExclusions.Exclude(params["model"], params["id"], conn), w)
+}
+
+// DeleteExclusion lets a thing, device or room be synced to the cloud again
+func (lr *SyncRouter) DeleteExclusion(params martini.Params, w http.ResponseWriter, syncExclusions *models.SyncExclusions, conn redis.Conn) {
+	lr.writeExclusionResult(syncExclusions.Include(params["model"], params["id"], conn), w)
+}
+
+// PutExcludedType keeps every thing of a type out of the cloud
+//
+// Request PUT /rest/v1/sync/exclusions/types/camera
+// Response 200
+//
+func (lr *SyncRouter) PutExcludedType(params martini.Params, w http.ResponseWriter, syncExclusions *models.SyncExclusions, conn redis.Conn) {
+	lr.writeExclusionResult(syncExclusions.ExcludeType(params["type"], conn), w)
+}
+
+// DeleteExcludedType lets things of a type be synced to the cloud again
+func (lr *SyncRouter) DeleteExcludedType(params martini.Params, w http.ResponseWriter, syncExclusions *models.SyncExclusions, conn redis.Conn) {
+	lr.writeExclusionResult(syncExclusions.IncludeType(params["type"], conn), w)
+}
+
+func (lr *SyncRouter) writeExclusionResult(err error, w http.ResponseWriter) {
+
+	if err == models.UnknownExclusionModel {
+		WriteServerErrorResponse(err.Error(), http.StatusBadRequest, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to update sync exclusions", http.StatusInternalServerError, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// PutModuleSecret flags a module's config as containing secrets, so it is only synced to the cloud
+// encrypted (if homecloud.sync.secretKey is set), and otherwise kept local
+//
+// Request PUT /rest/v1/sync/modules/driver-hue/secret
+// Response 200
+//
+func (lr *SyncRouter) PutModuleSecret(params martini.Params, w http.ResponseWriter, moduleModel *models.ModuleModel, conn redis.Conn) {
+	lr.writeModuleSecretResult(moduleModel.SetConfigSecret(params["id"], true, conn), params["id"], w)
+}
+
+// DeleteModuleSecret lets a module's config be synced to the cloud as it is
+func (lr *SyncRouter) DeleteModuleSecret(params martini.Params, w http.ResponseWriter, moduleModel *models.ModuleModel, conn redis.Conn) {
+	lr.writeModuleSecretResult(moduleModel.SetConfigSecret(params["id"], false, conn), params["id"], w)
+}
+
+func (lr *SyncRouter) writeModuleSecretResult(err error, id string, w http.ResponseWriter) {
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown module: %s", id), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to update module config", http.StatusInternalServerError, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
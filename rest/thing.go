@@ -9,6 +9,7 @@ import (
 	"github.com/go-martini/martini"
 	"github.com/ninjasphere/go-ninja/model"
 	"github.com/ninjasphere/redigo/redis"
+	"github.com/ninjasphere/sphere-go-homecloud/capabilities"
 	"github.com/ninjasphere/sphere-go-homecloud/models"
 )
 
@@ -25,6 +26,8 @@ func (lr *ThingRouter) Register(r martini.Router) {
 	r.Get("/:id", lr.GetThing)
 	r.Put("/:id", lr.PutThing)
 	r.Put("/:id/location", lr.PutThingLocation)
+	r.Post("/:id/replace-device", lr.PostReplaceDevice)
+	r.Get("/:id/capabilities", lr.GetThingCapabilities)
 	r.Delete("/:id", lr.DeleteThing)
 
 }
@@ -135,6 +138,62 @@ func (lr *ThingRouter) PutThingLocation(params martini.Params, r *http.Request,
 	w.WriteHeader(http.StatusOK)
 }
 
+// PostReplaceDevice moves a thing onto a new device, keeping its name, room and history
+//
+// Request {"deviceID":"2864dd823a","deleteOldDevice":true}
+// Response the updated thing
+//
+func (lr *ThingRouter) PostReplaceDevice(params martini.Params, r *http.Request, w http.ResponseWriter, thingModel *models.ThingModel, conn redis.Conn) {
+
+	request := &models.ReplaceDeviceRequest{}
+
+	err := json.NewDecoder(r.Body).Decode(request)
+
+	if err != nil || request.DeviceID == "" {
+		WriteServerErrorResponse("Unable to parse body, deviceID is required", http.StatusBadRequest, w)
+		return
+	}
+
+	request.ThingID = params["id"]
+
+	thing, err := thingModel.ReplaceDevice(request, conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown thing id: %s or device id: %s", params["id"], request.DeviceID), http.StatusNotFound, w)
+		return
+	}
+
+	if err == models.DeviceHasThing {
+		WriteServerErrorResponse(fmt.Sprintf("Device %s already has a promoted thing", request.DeviceID), http.StatusConflict, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to replace device", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(thing, http.StatusOK, w)
+}
+
+// GetThingCapabilities retrieves the methods and events of each of a thing's channels
+func (lr *ThingRouter) GetThingCapabilities(params martini.Params, w http.ResponseWriter, catalogue *capabilities.Catalogue, conn redis.Conn) {
+
+	thingCapabilities, err := catalogue.FetchThingCapabilities(params["id"], conn)
+
+	if err == models.RecordNotFound {
+		WriteServerErrorResponse(fmt.Sprintf("Unknown thing id: %s", params["id"]), http.StatusNotFound, w)
+		return
+	}
+
+	if err != nil {
+		WriteServerErrorResponse("Unable to retrieve thing capabilities", http.StatusInternalServerError, w)
+		return
+	}
+
+	WriteServerResponse(thingCapabilities, http.StatusOK, w)
+}
+
 // DeleteThing removes a thing using it's identifier
 func (lr *ThingRouter) DeleteThing(params martini.Params, w http.ResponseWriter, thingModel *models.ThingModel, conn redis.Conn) {
 
@@ -0,0 +1,119 @@
+package solar
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/api"
+	"github.com/ninjasphere/go-ninja/config"
+	"github.com/ninjasphere/go-ninja/logger"
+	"github.com/ninjasphere/redigo/redis"
+	"github.com/ninjasphere/sphere-go-homecloud/models"
+)
+
+// The longest we sleep before checking the site again, in case its location has changed
+var solarRecheckInterval = config.Duration(time.Hour, "homecloud.solar.recheckInterval")
+
+// SolarManager publishes the solar events of the current site (i.e. $site/:id/event/sunrise) as they happen
+type SolarManager struct {
+	Conn      *ninja.Connection `inject:""`
+	Pool      *redis.Pool       `inject:""`
+	SiteModel *models.SiteModel `inject:""`
+	log       *logger.Logger
+	done      chan bool
+}
+
+func NewSolarManager() *SolarManager {
+	return &SolarManager{
+		log:  logger.GetLogger("SolarManager"),
+		done: make(chan bool),
+	}
+}
+
+func (s *SolarManager) PostConstruct() error {
+	go s.run()
+	return nil
+}
+
+// Stop stops publishing solar events
+func (s *SolarManager) Stop() {
+	close(s.done)
+}
+
+// sleep waits for d, and returns false if the manager was stopped in the meantime
+func (s *SolarManager) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *SolarManager) run() {
+
+	last := time.Now()
+
+	for {
+		siteID, event, err := s.nextEvent(last)
+		if err != nil {
+			s.log.Debugf("Not publishing solar events: %s", err)
+			if !s.sleep(solarRecheckInterval) {
+				return
+			}
+			continue
+		}
+
+		wait := event.Time.Sub(time.Now())
+		if wait > solarRecheckInterval {
+			if !s.sleep(solarRecheckInterval) {
+				return
+			}
+			continue
+		}
+
+		if !s.sleep(wait) {
+			return
+		}
+
+		s.log.Infof("Solar event %s at site %s", event.Name, siteID)
+
+		if err := s.Conn.SendNotification(fmt.Sprintf("$site/%s/event/%s", siteID, event.Name), event); err != nil {
+			s.log.Warningf("Failed to publish solar event %s error: %s", event.Name, err)
+		}
+
+		last = event.Time
+	}
+}
+
+// nextEvent finds the first solar event at the current site after a given time
+func (s *SolarManager) nextEvent(after time.Time) (string, *Event, error) {
+
+	conn := s.Pool.Get()
+	defer conn.Close()
+
+	site, err := s.SiteModel.Fetch("here", conn)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Tomorrow's events are needed late in the day, and a day may be missing events entirely
+	// near the poles, so look a few days ahead.
+	for day := 0; day < 3; day++ {
+		times, err := ForSite(site, after.AddDate(0, 0, day))
+		if err != nil {
+			return "", nil, err
+		}
+
+		for _, event := range times.Events() {
+			if event.Time.After(after) {
+				return site.ID, &event, nil
+			}
+		}
+	}
+
+	return "", nil, fmt.Errorf("No solar events in the next few days at site %s", site.ID)
+}
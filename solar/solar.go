@@ -0,0 +1,144 @@
+package solar
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/model"
+)
+
+// Sun altitudes (in degrees) used for each event. Sunrise and sunset allow for refraction
+// and the size of the sun's disc.
+const (
+	sunriseAltitude = -0.833
+	civilAltitude   = -6.0
+)
+
+const (
+	julianUnixEpoch = 2440587.5
+	julian2000      = 2451545.0
+)
+
+// Times are the solar events for a single day. Events that don't happen that day (i.e. during
+// polar day or night) are nil.
+type Times struct {
+	Date      string     `json:"date"`
+	CivilDawn *time.Time `json:"civilDawn,omitempty"`
+	Sunrise   *time.Time `json:"sunrise,omitempty"`
+	SolarNoon time.Time  `json:"solarNoon"`
+	Sunset    *time.Time `json:"sunset,omitempty"`
+	CivilDusk *time.Time `json:"civilDusk,omitempty"`
+}
+
+// Event is a single named solar event
+type Event struct {
+	Name string    `json:"event"`
+	Time time.Time `json:"time"`
+}
+
+// Events returns the day's events in order, using the names they are published with
+func (t *Times) Events() []Event {
+	events := []Event{}
+
+	add := func(name string, at *time.Time) {
+		if at != nil {
+			events = append(events, Event{name, *at})
+		}
+	}
+
+	add("civil-dawn", t.CivilDawn)
+	add("sunrise", t.Sunrise)
+	add("solar-noon", &t.SolarNoon)
+	add("sunset", t.Sunset)
+	add("civil-dusk", t.CivilDusk)
+
+	return events
+}
+
+// Calculate works out the solar events of the day containing date (in date's location), at
+// the given latitude and longitude (east positive). It uses the simplified sunrise equation,
+// which is accurate to around a minute.
+func Calculate(date time.Time, latitude, longitude float64) *Times {
+
+	location := date.Location()
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0, location)
+
+	// Days since J2000, and the mean solar noon of that day at this longitude
+	n := math.Floor(toJulian(noon) - julian2000 + longitude/360 + 0.5)
+	meanNoon := n - longitude/360
+
+	anomaly := math.Mod(357.5291+0.98560028*meanNoon, 360)
+	center := 1.9148*sin(anomaly) + 0.02*sin(2*anomaly) + 0.0003*sin(3*anomaly)
+	eclipticLongitude := math.Mod(anomaly+center+180+102.9372, 360)
+
+	transit := julian2000 + meanNoon + 0.0053*sin(anomaly) - 0.0069*sin(2*eclipticLongitude)
+	declination := math.Asin(sin(eclipticLongitude) * sin(23.4397))
+
+	times := &Times{
+		Date:      noon.Format("2006-01-02"),
+		SolarNoon: fromJulian(transit).In(location),
+	}
+
+	times.Sunrise, times.Sunset = crossings(transit, latitude, declination, sunriseAltitude, location)
+	times.CivilDawn, times.CivilDusk = crossings(transit, latitude, declination, civilAltitude, location)
+
+	return times
+}
+
+// ForSite calculates the solar events of a day at a site, in the site's timezone
+func ForSite(site *model.Site, date time.Time) (*Times, error) {
+
+	if site.Latitude == nil || site.Longitude == nil {
+		return nil, fmt.Errorf("Site %s has no location", site.ID)
+	}
+
+	location, err := SiteLocation(site)
+	if err != nil {
+		return nil, err
+	}
+
+	return Calculate(date.In(location), *site.Latitude, *site.Longitude), nil
+}
+
+// SiteLocation returns the timezone of a site, falling back to the local timezone
+func SiteLocation(site *model.Site) (*time.Location, error) {
+	if site.TimeZoneID == nil || *site.TimeZoneID == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(*site.TimeZoneID)
+}
+
+// crossings returns when the sun passes through an altitude before and after transit
+func crossings(transit, latitude, declination, altitude float64, location *time.Location) (*time.Time, *time.Time) {
+
+	cosHourAngle := (sin(altitude) - sin(latitude)*math.Sin(declination)) / (cos(latitude) * math.Cos(declination))
+
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		// The sun never gets there today
+		return nil, nil
+	}
+
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+
+	rising := fromJulian(transit - hourAngle/360).In(location)
+	setting := fromJulian(transit + hourAngle/360).In(location)
+
+	return &rising, &setting
+}
+
+func toJulian(t time.Time) float64 {
+	return float64(t.UnixNano())/float64(24*time.Hour) + julianUnixEpoch
+}
+
+func fromJulian(j float64) time.Time {
+	return time.Unix(0, int64((j-julianUnixEpoch)*float64(24*time.Hour))).Round(time.Second)
+}
+
+func sin(degrees float64) float64 {
+	return math.Sin(degrees * math.Pi / 180)
+}
+
+func cos(degrees float64) float64 {
+	return math.Cos(degrees * math.Pi / 180)
+}